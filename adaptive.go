@@ -0,0 +1,175 @@
+package oaicrawl
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// adaptiveStart is the initial number of concurrent requests.
+	adaptiveStart = 2
+	// latencyFactor is how much slower than the best window of requests a
+	// window may be, before concurrency is reduced.
+	latencyFactor = 2
+)
+
+// outcome classifies a request for the concurrency controller.
+type outcome int
+
+const (
+	outcomeOK outcome = iota
+	// outcomeOverload means the endpoint is overloaded, e.g. timeouts or
+	// 503 responses.
+	outcomeOverload
+	// outcomeOther are failures, that say nothing about the load.
+	outcomeOther
+)
+
+// controller adapts the number of concurrent requests to the health of an
+// endpoint. After each window of successful requests, the limit is increased
+// by one, up to max. It is halved on overload and reduced by a quarter, if the
+// average latency of a window rises well above the best one seen (AIMD).
+type controller struct {
+	min, max int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    float64
+	active   int
+	done     int
+	latency  time.Duration
+	baseline time.Duration
+	// decreased is the time of the last decrease. Only requests started
+	// after it can cause another one.
+	decreased time.Time
+}
+
+// newController returns a controller allowing up to max concurrent requests.
+func newController(max int) *controller {
+	c := &controller{min: 1, max: max, limit: adaptiveStart}
+	if c.limit > float64(max) {
+		c.limit = float64(max)
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Limit returns the current number of allowed concurrent requests.
+func (c *controller) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.limit)
+}
+
+// acquire blocks until another request is allowed or ctx is done.
+func (c *controller) acquire(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active >= int(c.limit) {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.mu.Lock()
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for c.active >= int(c.limit) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.cond.Wait()
+	}
+	c.active++
+	return nil
+}
+
+// release ends a request started at started and adapts the limit.
+func (c *controller) release(started time.Time, o outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+	c.active--
+	switch o {
+	case outcomeOverload:
+		c.decrease(started, 0.5, "endpoint overloaded")
+	case outcomeOK:
+		c.done++
+		c.latency += time.Since(started)
+		if c.done < int(c.limit) {
+			return
+		}
+		avg := c.latency / time.Duration(c.done)
+		c.done, c.latency = 0, 0
+		if c.baseline == 0 || avg < c.baseline {
+			c.baseline = avg
+		}
+		if avg > latencyFactor*c.baseline {
+			c.decrease(started, 0.75, "latency rising to "+avg.String())
+			return
+		}
+		if int(c.limit) < c.max {
+			c.limit++
+			log.Info("concurrency: increased to ", int(c.limit), ", latency ", avg)
+		}
+	}
+}
+
+// decrease reduces the limit by a factor, once per congestion event.
+func (c *controller) decrease(started time.Time, factor float64, reason string) {
+	if !started.After(c.decreased) {
+		return
+	}
+	c.decreased = time.Now()
+	c.done, c.latency = 0, 0
+	c.limit *= factor
+	if c.limit < float64(c.min) {
+		c.limit = float64(c.min)
+	}
+	log.Info("concurrency: decreased to ", int(c.limit), ", ", reason)
+}
+
+// classify returns the outcome of a request.
+func classify(resp *http.Response, err error) outcome {
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return outcomeOverload
+		}
+		return outcomeOther
+	}
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusGatewayTimeout:
+		return outcomeOverload
+	}
+	if resp.StatusCode >= 400 {
+		return outcomeOther
+	}
+	return outcomeOK
+}
+
+// adaptiveFetcher limits concurrent requests with a controller.
+type adaptiveFetcher struct {
+	Fetcher
+	controller *controller
+}
+
+// Do performs the request, once the controller allows it, and reports its
+// outcome.
+func (f *adaptiveFetcher) Do(req *http.Request) (*http.Response, error) {
+	if err := f.controller.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	resp, err := f.Fetcher.Do(req)
+	f.controller.release(started, classify(resp, err))
+	return resp, err
+}
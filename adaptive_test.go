@@ -0,0 +1,147 @@
+package oaicrawl
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestController(t *testing.T) {
+	c := newController(4)
+	if c.Limit() != adaptiveStart {
+		t.Fatalf("got limit %d, want %d", c.Limit(), adaptiveStart)
+	}
+	// Windows of successful requests increase the limit up to max.
+	for i := 0; i < 20; i++ {
+		c.acquire(context.Background())
+		c.release(time.Now(), outcomeOK)
+	}
+	if c.Limit() != 4 {
+		t.Errorf("got limit %d, want 4", c.Limit())
+	}
+	// Overload halves the limit, but only once for concurrent requests.
+	started := time.Now()
+	for i := 0; i < 2; i++ {
+		c.acquire(context.Background())
+	}
+	c.release(started, outcomeOverload)
+	c.release(started, outcomeOverload)
+	if c.Limit() != 2 {
+		t.Errorf("got limit %d, want 2", c.Limit())
+	}
+	// Other failures do not change the limit.
+	c.acquire(context.Background())
+	c.release(time.Now(), outcomeOther)
+	if c.Limit() != 2 {
+		t.Errorf("got limit %d, want 2", c.Limit())
+	}
+
+	// Requests beyond the limit wait until ctx is done.
+	c.acquire(context.Background())
+	c.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	var cases = []struct {
+		status int
+		err    error
+		want   outcome
+	}{
+		{200, nil, outcomeOK},
+		{503, nil, outcomeOverload},
+		{429, nil, outcomeOverload},
+		{404, nil, outcomeOther},
+		{0, errors.New("connection refused"), outcomeOther},
+		{0, timeoutError{}, outcomeOverload},
+	}
+	for _, c := range cases {
+		var resp *http.Response
+		if c.err == nil {
+			resp = &http.Response{StatusCode: c.status}
+		}
+		if got := classify(resp, c.err); got != c.want {
+			t.Errorf("classify(%d, %v): got %v, want %v", c.status, c.err, got, c.want)
+		}
+	}
+}
+
+// timeoutError is a network timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRunAdaptive(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(40), PageSize: 50, Delay: 10 * time.Millisecond}
+	var (
+		mu           sync.Mutex
+		active, peak int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	h := NewHarvester(ts.URL)
+	h.Output = ioutil.Discard
+	h.NumWorkers = 6
+	h.Adaptive = true
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if peak > 6 {
+		t.Errorf("got %d concurrent requests, want at most 6", peak)
+	}
+	if h.controller.Limit() <= adaptiveStart {
+		t.Errorf("concurrency not increased: %d", h.controller.Limit())
+	}
+}
+
+func TestAdaptiveAttempts(t *testing.T) {
+	var once sync.Once
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { time.Sleep(200 * time.Millisecond) })
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	// The first attempt times out and is retried by the fetcher, the
+	// controller sees the timeout nonetheless.
+	h := NewHarvester(ts.URL)
+	c := newController(4)
+	client := h.wrap(NewRetryFetcher(&http.Client{Timeout: 50 * time.Millisecond}, 1), c)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+	if c.decreased.IsZero() {
+		t.Errorf("timeout not reported to controller")
+	}
+}
@@ -0,0 +1,231 @@
+package oaicrawl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// checkpointEvent is a single line in a checkpoint file. Each line records one
+// kind of event, the initial event records endpoint and format.
+type checkpointEvent struct {
+	Base     string  `json:"base,omitempty"`
+	Format   string  `json:"format,omitempty"`
+	Queued   string  `json:"queued,omitempty"`
+	Done     string  `json:"done,omitempty"`
+	Failed   string  `json:"failed,omitempty"`
+	Token    *string `json:"token,omitempty"`
+	Complete bool    `json:"complete,omitempty"`
+	// Verb and Set qualify Token and Complete. A missing verb means
+	// ListIdentifiers.
+	Verb string `json:"verb,omitempty"`
+	Set  string `json:"set,omitempty"`
+}
+
+// Checkpoint keeps track of the progress of a harvest in an append-only state
+// file, one JSON object per line. It records every queued, written and failed
+// identifier as well as the last resumption token, so an interrupted harvest
+// can continue where it stopped. A Checkpoint is safe for concurrent use.
+type Checkpoint struct {
+	mu       sync.Mutex
+	f        *os.File
+	base     string
+	format   string
+	tokens   map[string]string
+	complete map[string]bool
+	queued   map[string]bool
+	done     map[string]bool
+	failed   map[string]bool
+}
+
+// OpenCheckpoint reads the state recorded in filename, if it exists, and opens
+// the file for further updates.
+func OpenCheckpoint(filename string) (*Checkpoint, error) {
+	c := &Checkpoint{
+		tokens:   make(map[string]string),
+		complete: make(map[string]bool),
+		queued:   make(map[string]bool),
+		done:     make(map[string]bool),
+		failed:   make(map[string]bool),
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.load(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("checkpoint %s: %v", filename, err)
+	}
+	// Drop a partial last line, so the next event starts on a line of its own.
+	if err := f.Truncate(n); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+// load replays the events of a state file and returns the length of the
+// complete lines read.
+func (c *Checkpoint) load(r io.Reader) (n int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line stems from a crash during a write.
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		var ev checkpointEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return n, err
+		}
+		c.apply(ev)
+		n += int64(len(line))
+	}
+}
+
+// apply updates the in-memory state with an event.
+func (c *Checkpoint) apply(ev checkpointEvent) {
+	switch {
+	case ev.Base != "":
+		c.base, c.format = ev.Base, ev.Format
+	case ev.Queued != "":
+		c.queued[ev.Queued] = true
+	case ev.Done != "":
+		c.done[ev.Done] = true
+		delete(c.failed, ev.Done)
+	case ev.Failed != "":
+		c.failed[ev.Failed] = true
+	case ev.Token != nil:
+		c.tokens[listKey(ev.Verb, ev.Set)] = *ev.Token
+	case ev.Complete:
+		c.complete[listKey(ev.Verb, ev.Set)] = true
+	}
+}
+
+// record applies an event and appends it to the state file.
+func (c *Checkpoint) record(ev checkpointEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apply(ev)
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = c.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying state file.
+func (c *Checkpoint) Close() error {
+	return c.f.Close()
+}
+
+// begin records endpoint and format of a new harvest or checks, whether a
+// resumed harvest uses the same endpoint and format.
+func (c *Checkpoint) begin(base, format string) error {
+	c.mu.Lock()
+	b, f := c.base, c.format
+	c.mu.Unlock()
+	if b == "" {
+		return c.record(checkpointEvent{Base: base, Format: format})
+	}
+	if b != base || f != format {
+		return fmt.Errorf("checkpoint is for %s (%s), not %s (%s)", b, f, base, format)
+	}
+	return nil
+}
+
+// listKey identifies a list request for a set, where set may be empty.
+func listKey(verb, set string) string {
+	if verb == "" {
+		verb = "ListIdentifiers"
+	}
+	return verb + " " + set
+}
+
+// Token returns the last recorded resumption token of a list request (verb is
+// ListIdentifiers or ListRecords) for a set, or for the whole repository, if
+// set is empty. All identifiers listed before this token have been queued.
+func (c *Checkpoint) Token(verb, set string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[listKey(verb, set)]
+}
+
+// Complete reports, whether a list request for a set, or for the whole
+// repository, if set is empty, has been completed.
+func (c *Checkpoint) Complete(verb, set string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.complete[listKey(verb, set)]
+}
+
+// Seen reports, whether an identifier has been queued before.
+func (c *Checkpoint) Seen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued[id] || c.done[id]
+}
+
+// Outstanding returns the identifiers, which have been queued but not
+// written, including failed ones, in sorted order.
+func (c *Checkpoint) Outstanding() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for id := range c.queued {
+		if !c.done[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Failed returns the identifiers, that could not be fetched, in sorted order.
+func (c *Checkpoint) Failed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for id := range c.failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Len returns the number of written records.
+func (c *Checkpoint) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.done)
+}
+
+func (c *Checkpoint) markQueued(id string) error {
+	return c.record(checkpointEvent{Queued: id})
+}
+
+func (c *Checkpoint) markDone(id string) error {
+	return c.record(checkpointEvent{Done: id})
+}
+
+func (c *Checkpoint) markFailed(id string) error {
+	return c.record(checkpointEvent{Failed: id})
+}
+
+func (c *Checkpoint) markToken(verb, set, token string) error {
+	return c.record(checkpointEvent{Token: &token, Verb: verb, Set: set})
+}
+
+func (c *Checkpoint) markComplete(verb, set string) error {
+	return c.record(checkpointEvent{Complete: true, Verb: verb, Set: set})
+}
@@ -0,0 +1,136 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(200), PageSize: 10, Delay: 5 * time.Millisecond}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.jsonl")
+
+	var buf bytes.Buffer
+
+	// Interrupt a first harvest.
+	c, err := OpenCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHarvester(ts.URL)
+	h.NumWorkers = 2
+	h.Output = &buf
+	h.Checkpoint = c
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	partial := len(ids(buf.Bytes()))
+	if partial == 0 || partial == 200 {
+		t.Fatalf("got %d records, want a partial harvest", partial)
+	}
+
+	// Resume from the state file.
+	c, err = OpenCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Len() != partial {
+		t.Errorf("checkpoint has %d records done, want %d", c.Len(), partial)
+	}
+	h = NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Checkpoint = c
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids(buf.Bytes()) {
+		if seen[id] {
+			t.Errorf("duplicate record: %s", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 200 {
+		t.Errorf("got %d records, want 200", len(seen))
+	}
+	if !c.Complete("ListIdentifiers", "") || len(c.Outstanding()) != 0 {
+		t.Errorf("checkpoint not complete after resumed harvest")
+	}
+
+	// A different endpoint must not use this checkpoint.
+	h = NewHarvester("http://example.com/oai")
+	h.Checkpoint = c
+	if err := h.Run(); err == nil {
+		t.Errorf("expected error for mismatched endpoint")
+	}
+}
+
+var identifierPattern = regexp.MustCompile(`<identifier>([^<]*)</identifier>`)
+
+// ids returns the record identifiers found in harvested data.
+func ids(b []byte) (result []string) {
+	for _, m := range identifierPattern.FindAllSubmatch(b, -1) {
+		result = append(result, string(m[1]))
+	}
+	return result
+}
+
+func TestCheckpointTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oaicrawl-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.jsonl")
+
+	c, err := OpenCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.begin("http://example.org/oai", "oai_dc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.markDone("oai:test:0"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing an event.
+	if _, err := c.f.Write([]byte(`{"done":"oai:te`)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for i := 1; i <= 2; i++ {
+		c, err := OpenCheckpoint(filename)
+		if err != nil {
+			t.Fatalf("resume %d: %v", i, err)
+		}
+		if c.Len() != i {
+			t.Errorf("resume %d: got %d records done, want %d", i, c.Len(), i)
+		}
+		if err := c.markDone(fmt.Sprintf("oai:test:%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+}
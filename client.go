@@ -0,0 +1,187 @@
+package oaicrawl
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultMaxRetries is the number of retries of failed requests by default.
+const defaultMaxRetries = 3
+
+// Client performs single OAI-PMH requests against an endpoint and decodes the
+// responses. Protocol errors reported by the endpoint are returned as
+// *ProtocolError, which wraps the OAIError. List requests return a single
+// page, the next one is requested with the resumption token of the response.
+type Client struct {
+	Base    string
+	Fetcher Fetcher
+	// Method is the HTTP method of requests, GET or POST. GET requests
+	// rejected as too long are sent again as POST.
+	Method string
+}
+
+// NewClient creates a client for an endpoint, which retries failed requests
+// like a harvester with default options.
+func NewClient(base string) *Client {
+	return &Client{
+		Base:    base,
+		Fetcher: NewRetryFetcher(&http.Client{Timeout: 60 * time.Second}, defaultMaxRetries),
+		Method:  http.MethodGet,
+	}
+}
+
+// Client returns a client for the endpoint of the harvester, which uses the
+// same fetcher, retries and request method.
+func (h *Harvester) Client() *Client {
+	client := h.Fetcher
+	if client == nil {
+		client = h.listFetcher()
+	}
+	return &Client{Base: h.Base, Fetcher: client, Method: h.Method}
+}
+
+// ListOptions select the records of a ListIdentifiers or ListRecords request.
+// If ResumptionToken is set, the other options are not sent, as required by
+// the protocol.
+type ListOptions struct {
+	MetadataPrefix string
+	Set            string
+	From           time.Time
+	Until          time.Time
+	// Granularity of From and Until, days if empty.
+	Granularity     string
+	ResumptionToken string
+}
+
+// values returns the request parameters for the options.
+func (o ListOptions) values(verb string) url.Values {
+	v := url.Values{"verb": {verb}}
+	if o.ResumptionToken != "" {
+		v.Set("resumptionToken", o.ResumptionToken)
+		return v
+	}
+	v.Set("metadataPrefix", o.MetadataPrefix)
+	if o.Set != "" {
+		v.Set("set", o.Set)
+	}
+	if !o.From.IsZero() {
+		v.Set("from", formatDatestamp(o.From, o.Granularity))
+	}
+	if !o.Until.IsZero() {
+		v.Set("until", formatDatestamp(endOfDay(o.Until, o.Granularity), o.Granularity))
+	}
+	return v
+}
+
+// Identify requests information about the repository.
+func (c *Client) Identify(ctx context.Context) (*IdentifyResponse, error) {
+	var resp IdentifyResponse
+	if err := c.get(ctx, url.Values{"verb": {"Identify"}}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListSets requests the sets of the repository, starting at token, if not
+// empty.
+func (c *Client) ListSets(ctx context.Context, token string) (*ListSetsResponse, error) {
+	v := url.Values{"verb": {"ListSets"}}
+	if token != "" {
+		v.Set("resumptionToken", token)
+	}
+	var resp ListSetsResponse
+	if err := c.get(ctx, v, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListMetadataFormats requests the metadata formats available for a record,
+// or in the repository, if identifier is empty.
+func (c *Client) ListMetadataFormats(ctx context.Context, identifier string) (*ListMetadataFormatsResponse, error) {
+	v := url.Values{"verb": {"ListMetadataFormats"}}
+	if identifier != "" {
+		v.Set("identifier", identifier)
+	}
+	var resp ListMetadataFormatsResponse
+	if err := c.get(ctx, v, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListIdentifiers requests a page of headers.
+func (c *Client) ListIdentifiers(ctx context.Context, opts ListOptions) (*ListIdentifiersResponse, error) {
+	var resp ListIdentifiersResponse
+	if err := c.get(ctx, opts.values("ListIdentifiers"), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListRecords requests a page of records.
+func (c *Client) ListRecords(ctx context.Context, opts ListOptions) (*ListRecordsResponse, error) {
+	var resp ListRecordsResponse
+	if err := c.get(ctx, opts.values("ListRecords"), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetRecord requests a single record in a metadata format.
+func (c *Client) GetRecord(ctx context.Context, identifier, metadataPrefix string) (*GetRecordResponse, error) {
+	v := url.Values{
+		"verb":           {"GetRecord"},
+		"identifier":     {identifier},
+		"metadataPrefix": {metadataPrefix},
+	}
+	var resp GetRecordResponse
+	if err := c.get(ctx, v, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// get performs a request with the given parameters and decodes the response
+// into v.
+func (c *Client) get(ctx context.Context, params url.Values, v response) error {
+	if err := checkMethod(c.Method); err != nil {
+		return err
+	}
+	base, err := url.Parse(c.Base)
+	if err != nil {
+		return err
+	}
+	client := &methodFetcher{Fetcher: c.Fetcher, post: c.Method == http.MethodPost}
+	return fetch(ctx, client, requestLink(base, params), v)
+}
+
+// requestLink returns the link to a request with the given parameters, which
+// are escaped. The query of base is kept, unless overridden by a parameter.
+// The verb comes first, followed by the other parameters in sorted order.
+func requestLink(base *url.URL, params url.Values) string {
+	q := base.Query()
+	rest := make(url.Values)
+	for k, v := range params {
+		q.Del(k)
+		if k != "verb" {
+			rest[k] = v
+		}
+	}
+	var parts []string
+	for _, s := range []string{
+		q.Encode(),
+		url.Values{"verb": params["verb"]}.Encode(),
+		rest.Encode(),
+	} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	u := *base
+	u.RawQuery = strings.Join(parts, "&")
+	return u.String()
+}
@@ -0,0 +1,151 @@
+package oaicrawl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: []string{"oai:test:1", "oai:test:a&b c+d", "oai:test:3"},
+		PageSize:    2,
+		Granularity: GranularityDay,
+		SetSpecs: map[string][]string{
+			"oai:test:1": {"a"},
+			"oai:test:3": {"b:c", "a"},
+		},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL + "?key=secret", Fetcher: http.DefaultClient}
+	ctx := context.Background()
+
+	ir, err := c.Identify(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Identify.Granularity != GranularityDay {
+		t.Errorf("got granularity %q", ir.Identify.Granularity)
+	}
+
+	lsr, err := c.ListSets(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lsr.ListSets.Sets); n != 2 {
+		t.Errorf("got %d sets, want 2", n)
+	}
+
+	lmr, err := c.ListMetadataFormats(ctx, "oai:test:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := lmr.ListMetadataFormats.MetadataFormats; len(f) != 1 || f[0].MetadataPrefix != "oai_dc" {
+		t.Errorf("got formats %v", f)
+	}
+
+	var ids []string
+	opts := ListOptions{MetadataPrefix: "oai_dc", From: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for {
+		lir, err := c.ListIdentifiers(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range lir.ListIdentifiers.Headers {
+			ids = append(ids, h.Identifier)
+		}
+		if opts.ResumptionToken = lir.ListIdentifiers.ResumptionToken.Value; opts.ResumptionToken == "" {
+			break
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("got %d identifiers, want 3", len(ids))
+	}
+
+	lrr, err := c.ListRecords(ctx, ListOptions{MetadataPrefix: "oai_dc", Set: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recs := lrr.ListRecords.Records; len(recs) != 1 || recs[0].Header.Identifier != "oai:test:3" {
+		t.Errorf("got records %v", recs)
+	}
+
+	grr, err := c.GetRecord(ctx, "oai:test:a&b c+d", "oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := grr.GetRecord.Record.Header.Identifier; id != "oai:test:a&b c+d" {
+		t.Errorf("got identifier %q", id)
+	}
+
+	for _, form := range repo.Forms("") {
+		t.Errorf("request without verb: %v", form)
+	}
+	for _, verb := range []string{"Identify", "ListSets", "ListMetadataFormats", "ListIdentifiers",
+		"ListRecords", "GetRecord"} {
+		for _, form := range repo.Forms(verb) {
+			if form.Get("key") != "secret" {
+				t.Errorf("%s: base query not kept: %v", verb, form)
+			}
+		}
+	}
+	forms := repo.Forms("ListIdentifiers")
+	if len(forms) != 2 || forms[0].Get("from") != "2017-01-01" || forms[1].Get("metadataPrefix") != "" {
+		t.Errorf("got ListIdentifiers requests %v", forms)
+	}
+}
+
+func TestClientProtocolError(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(1), Errors: map[string]string{
+		"oai:test:0": "cannotDisseminateFormat",
+	}}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+	_, err := c.GetRecord(context.Background(), "oai:test:0", "mods")
+	perr, ok := err.(*ProtocolError)
+	if !ok {
+		t.Fatalf("got %v, want protocol error", err)
+	}
+	if perr.Err.Code != "cannotDisseminateFormat" {
+		t.Errorf("got code %q", perr.Err.Code)
+	}
+	if _, err := c.ListMetadataFormats(context.Background(), "oai:test:missing"); err == nil {
+		t.Error("expected error for unknown identifier")
+	}
+}
+
+func TestHarvesterClient(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(1), Granularity: GranularitySecond}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	h := NewHarvester(ts.URL)
+	var fetcher countingFetcher
+	h.Fetcher = &fetcher
+	ir, err := h.Client().Identify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Identify.Granularity != GranularitySecond {
+		t.Errorf("got granularity %q", ir.Identify.Granularity)
+	}
+	if fetcher.n != 1 {
+		t.Errorf("harvester fetcher used %d times, want 1", fetcher.n)
+	}
+}
+
+// countingFetcher counts requests.
+type countingFetcher struct {
+	n int
+}
+
+func (f *countingFetcher) Do(req *http.Request) (*http.Response, error) {
+	f.n++
+	return http.DefaultClient.Do(req)
+}
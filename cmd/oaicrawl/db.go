@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/miku/oaicrawl"
+)
+
+// dbStore is a record store in a database, as opened with -db.
+type dbStore interface {
+	io.Writer
+	oaicrawl.RecordStore
+	Close() error
+}
+
+// openDB opens the database of -db for records in format. It is only
+// available in builds with the sqlite tag, since the SQLite driver requires
+// cgo.
+var openDB = func(filename, format string) (dbStore, error) {
+	return nil, errors.New("-db requires a build with -tags sqlite")
+}
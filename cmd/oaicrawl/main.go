@@ -2,10 +2,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/miku/oaicrawl"
@@ -23,9 +30,128 @@ var (
 	bestEffort     = flag.Bool("b", false, "create best effort data set")
 	maxElapsedTime = flag.Duration("e", 12*time.Second, "max elapsed time")
 	numWorkers     = flag.Int("w", 4*runtime.NumCPU(), "number of parallel connections")
+	from           = flag.String("from", "", "harvest records changed on or after this date (2006-01-02 or 2006-01-02T15:04:05Z)")
+	until          = flag.String("until", "", "harvest records changed on or before this date (2006-01-02 or 2006-01-02T15:04:05Z)")
+	filterSets     = flag.Bool("filter-sets", false, "filter sets on the client side, for endpoints with a broken set parameter")
+	strategy       = flag.String("strategy", "per-record", "per-record, list-records, auto (switch to per-record on failure) or hybrid (per-record for failed pages)")
+	outputFormat   = flag.String("output-format", "raw", "raw (GetRecord responses), jsonl (one JSON object per record), xml (single document) or warc (all HTTP exchanges)")
+	resume         = flag.String("resume", "", "record progress in this state file and resume from it, if it exists")
+	outputDir      = flag.String("o", "", "write rotating files and a manifest into this directory instead of stdout")
+	shardRecords   = flag.Int("shard-records", 100000, "with -o, start a new file after this many records, 0 for no limit")
+	shardBytes     = flag.Int64("shard-bytes", 0, "with -o, start a new file after this many uncompressed bytes, 0 for no limit")
+	recordsDir     = flag.String("records-dir", "", "store each record as a file in this directory, mirroring the repository")
+	tombstones     = flag.Bool("tombstones", false, "with -records-dir, keep deleted records as .deleted files instead of removing them")
+	deletedPolicy  = flag.String("deleted", "tombstone", "deleted records: tombstone (header only), skip or file (see -deletions)")
+	deletionsFile  = flag.String("deletions", "", "with -deleted file, write deleted records to this file, as JSON lines")
+	adaptive       = flag.Bool("adaptive", false, "adapt the number of parallel connections to the endpoint, up to -w")
+	rateLimit      = flag.Float64("rate", 0, "max requests per second for all connections together, 0 for no limit")
+	burst          = flag.Int("burst", 1, "with -rate, allow this many requests at once")
+	minDelay       = flag.Duration("min-delay", 0, "minimum delay between the start of two requests")
+	method         = flag.String("method", "get", "request method, get (post for requests rejected as too long) or post")
+	failuresFile   = flag.String("failures", "", "write records, that could not be harvested, to this file, as JSON lines")
+	endpointsFile  = flag.String("endpoints", "", "harvest the endpoints listed in this file, one per line, into files in -o")
+	perHost        = flag.Int("per-host", 4, "with -endpoints, max parallel connections per host, -w is the overall limit")
+	maxEndpoints   = flag.Int("max-endpoints", 8, "with -endpoints, max endpoints harvested at a time")
+	idsFile        = flag.String("ids", "", "harvest only the identifiers in this file, one per line, - for stdin")
+	database       = flag.String("db", "", "upsert records into this SQLite database, see oaiquery (requires build with -tags sqlite)")
+	compression    = flag.String("compress", "gzip", "with -o, compress files with none, gzip or zstd (requires zstd executable)")
 )
 
+// stringList collects the values of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// nonEmpty returns the number of non-empty values.
+func nonEmpty(values ...string) (n int) {
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// createFailures creates the file for -failures. If it is the file read with
+// -ids, failures are written to a temporary file in the same directory
+// instead, which replaces the input after the harvest.
+func createFailures(filename string, ids *os.File) (*os.File, error) {
+	if ids != nil {
+		fi, ferr := os.Stat(filename)
+		ii, ierr := ids.Stat()
+		if ferr == nil && ierr == nil && os.SameFile(fi, ii) {
+			return ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+		}
+	}
+	return os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+// replaceFile closes f and renames it to filename.
+func replaceFile(f *os.File, filename string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// runEndpoints harvests the endpoints listed in a file, each into its own files.
+func runEndpoints(ctx context.Context, configure func(*oaicrawl.Harvester)) {
+	if nonEmpty(*resume, *idsFile, *database, *recordsDir, *failuresFile, *deletionsFile) > 0 {
+		log.Fatal("-endpoints cannot be combined with -resume, -ids, -db, -records-dir, -failures or -deletions")
+	}
+	if *outputDir == "" {
+		log.Fatal("-endpoints requires -o")
+	}
+	if *numWorkers <= 0 || *perHost <= 0 {
+		log.Fatal("-w and -per-host must be positive")
+	}
+	f, err := os.Open(*endpointsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	endpoints, err := oaicrawl.ParseEndpoints(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := oaicrawl.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	runner := oaicrawl.NewRunner(endpoints, *outputDir)
+	runner.MaxEndpoints = *maxEndpoints
+	runner.MaxWorkers = *numWorkers
+	runner.PerHost = *perHost
+	runner.MaxRecords = *shardRecords
+	runner.MaxBytes = *shardBytes
+	runner.Compression = c
+	runner.Configure = configure
+	var failed int
+	for _, result := range runner.Run(ctx) {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if ctx.Err() == context.Canceled {
+		log.Warn("harvest interrupted")
+		return
+	}
+	if failed > 0 {
+		log.Fatal(failed, " endpoints failed")
+	}
+}
+
 func main() {
+	var sets stringList
+	flag.Var(&sets, "set", "harvest only this set, repeatable")
 	flag.Parse()
 
 	if *version {
@@ -35,22 +161,174 @@ func main() {
 
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
 
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	s, err := oaicrawl.ParseStrategy(*strategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	of, err := oaicrawl.ParseOutputFormat(*outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dp, err := oaicrawl.ParseDeletedPolicy(*deletedPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var fromDate, untilDate time.Time
+	if *from != "" {
+		if fromDate, err = oaicrawl.ParseDatestamp(*from); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *until != "" {
+		if untilDate, err = oaicrawl.ParseDatestamp(*until); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// configure sets the options shared by all endpoints.
+	configure := func(h *oaicrawl.Harvester) {
+		h.MaxRetries = *maxRetries
+		h.MaxElapsedTime = *maxElapsedTime
+		h.Format = *format
+		h.BestEffort = *bestEffort
+		h.NumWorkers = *numWorkers
+		h.Sets = sets
+		h.FilterSets = *filterSets
+		h.Adaptive = *adaptive
+		h.RateLimit = *rateLimit
+		h.Burst = *burst
+		h.MinDelay = *minDelay
+		h.Method = strings.ToUpper(*method)
+		h.Strategy = s
+		h.OutputFormat = of
+		h.DeletedPolicy = dp
+		h.From = fromDate
+		h.Until = untilDate
+	}
+
+	// Stop harvesting on SIGINT or SIGTERM, but keep what we have.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Warn("received ", sig, ", shutting down")
+		cancel()
+	}()
+
+	if *endpointsFile != "" {
+		runEndpoints(ctx, configure)
+		return
+	}
+
 	if flag.NArg() == 0 {
 		log.Fatal("endpoint required")
 	}
 
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
+	harvester := oaicrawl.NewHarvester(flag.Arg(0))
+	configure(harvester)
+
+	if dp == oaicrawl.DeletedFile {
+		if *deletionsFile == "" {
+			log.Fatal("-deleted file requires -deletions")
+		}
+		f, err := os.OpenFile(*deletionsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		harvester.Deletions = f
 	}
 
-	harvester := oaicrawl.NewHarvester(flag.Arg(0))
-	harvester.MaxRetries = *maxRetries
-	harvester.MaxElapsedTime = *maxElapsedTime
-	harvester.Format = *format
-	harvester.BestEffort = *bestEffort
-	harvester.NumWorkers = *numWorkers
+	var ids *os.File
+	switch *idsFile {
+	case "":
+	case "-":
+		harvester.Identifiers = oaicrawl.NewReaderSource(os.Stdin)
+	default:
+		ids, err = os.Open(*idsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ids.Close()
+		harvester.Identifiers = oaicrawl.NewReaderSource(ids)
+	}
 
-	if err := harvester.Run(); err != nil {
+	var failures *os.File
+	if *failuresFile != "" {
+		failures, err = createFailures(*failuresFile, ids)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer failures.Close()
+		harvester.Failures = failures
+	}
+
+	if *resume != "" {
+		checkpoint, err := oaicrawl.OpenCheckpoint(*resume)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer checkpoint.Close()
+		harvester.Checkpoint = checkpoint
+	}
+
+	// finish flushes or closes the output after the harvest.
+	var finish func() error
+	switch {
+	case nonEmpty(*outputDir, *recordsDir, *database) > 1:
+		log.Fatal("-o, -records-dir and -db are mutually exclusive")
+	case *database != "":
+		if of != oaicrawl.OutputRaw {
+			log.Fatal("-db requires raw output format")
+		}
+		store, err := openDB(*database, *format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		harvester.Output, finish = store, store.Close
+	case *recordsDir != "":
+		store := oaicrawl.NewDirStore(*recordsDir, of.Extension())
+		store.Tombstones = *tombstones
+		harvester.Output, finish = store, func() error { return nil }
+	case *outputDir != "":
+		c, err := oaicrawl.ParseCompression(*compression)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sw := oaicrawl.NewShardWriter(*outputDir, of.Extension())
+		sw.MaxRecords = *shardRecords
+		sw.MaxBytes = *shardBytes
+		sw.Compression = c
+		harvester.Output, finish = sw, sw.Close
+	default:
+		bw := bufio.NewWriter(os.Stdout)
+		harvester.Output, finish = bw, bw.Flush
+	}
+
+	err = harvester.RunContext(ctx)
+	if ferr := finish(); ferr != nil {
+		log.Fatal(ferr)
+	}
+	if failures != nil && failures.Name() != *failuresFile {
+		// The input is only replaced, once every identifier was requested.
+		if err == nil {
+			if ferr := replaceFile(failures, *failuresFile); ferr != nil {
+				log.Fatal(ferr)
+			}
+		} else {
+			log.Warn("failures written to ", failures.Name(), ", ", *failuresFile, " left unchanged")
+		}
+	}
+	switch {
+	case err == context.Canceled:
+		log.Warn("harvest interrupted")
+	case err != nil:
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,17 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import "github.com/miku/oaicrawl/sqlitestore"
+
+func init() {
+	openDB = func(filename, format string) (dbStore, error) {
+		store, err := sqlitestore.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		store.Format = format
+		return store, nil
+	}
+}
@@ -0,0 +1,61 @@
+// oaiquery looks up records in a database maintained by oaicrawl -db and
+// writes them as JSON, one record per line.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/miku/oaicrawl/sqlitestore"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	database   = flag.String("db", "", "database file, as written by oaicrawl -db")
+	identifier = flag.String("id", "", "record identifier")
+	format     = flag.String("f", "", "metadata prefix")
+	set        = flag.String("set", "", "records in this set or its subsets")
+	from       = flag.String("from", "", "records with a datestamp on or after this date (2006-01-02 or 2006-01-02T15:04:05Z)")
+	until      = flag.String("until", "", "records with a datestamp on or before this date (2006-01-02 or 2006-01-02T15:04:05Z)")
+	deleted    = flag.Bool("deleted", false, "include deleted records")
+)
+
+func main() {
+	flag.Parse()
+
+	if *database == "" {
+		log.Fatal("-db required")
+	}
+	if _, err := os.Stat(*database); err != nil {
+		log.Fatal(err)
+	}
+	store, err := sqlitestore.Open(*database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	records, err := store.Find(sqlitestore.Query{
+		Identifier:     *identifier,
+		MetadataPrefix: *format,
+		Set:            *set,
+		From:           *from,
+		Until:          *until,
+		Deleted:        *deleted,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	bw := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(bw)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
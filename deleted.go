@@ -0,0 +1,125 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeletedPolicy determines, what happens with deleted records. Deleted
+// records are never requested with GetRecord, if their header is listed as
+// deleted.
+type DeletedPolicy int
+
+const (
+	// DeletedTombstone writes deleted records to Output, with a header only.
+	DeletedTombstone DeletedPolicy = iota
+	// DeletedSkip drops deleted records.
+	DeletedSkip
+	// DeletedFile writes deleted records to Deletions instead of Output.
+	DeletedFile
+)
+
+var deletedPolicyNames = map[DeletedPolicy]string{
+	DeletedTombstone: "tombstone",
+	DeletedSkip:      "skip",
+	DeletedFile:      "file",
+}
+
+// String returns the name of the policy.
+func (p DeletedPolicy) String() string {
+	if name, ok := deletedPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("DeletedPolicy(%d)", int(p))
+}
+
+// ParseDeletedPolicy returns the policy for a name, as returned by String.
+func ParseDeletedPolicy(name string) (DeletedPolicy, error) {
+	for p, n := range deletedPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown deleted policy: %s", name)
+}
+
+// isDeleted reports, whether a header marks a deleted record.
+func isDeleted(header Header) bool {
+	return header.Status == "deleted"
+}
+
+// tombstone returns a result for a deleted record, shaped like a GetRecord
+// response with a header only.
+func (h *Harvester) tombstone(header Header, link string) result {
+	header.Status = "deleted"
+	var buf bytes.Buffer
+	buf.WriteString(`<record><header status="deleted"><identifier>`)
+	xml.EscapeText(&buf, []byte(header.Identifier))
+	buf.WriteString("</identifier><datestamp>")
+	xml.EscapeText(&buf, []byte(header.DateStamp))
+	buf.WriteString("</datestamp>")
+	for _, spec := range header.SetSpec {
+		buf.WriteString("<setSpec>")
+		xml.EscapeText(&buf, []byte(spec))
+		buf.WriteString("</setSpec>")
+	}
+	buf.WriteString("</header></record>")
+	rec := rawRecord{Header: header, Raw: buf.Bytes()}
+	responseDate := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	return result{
+		Identifier: header.Identifier,
+		URL:        link,
+		Body:       h.envelope(responseDate, rec),
+		Header:     header,
+	}
+}
+
+// writeDeletion writes a deleted record as JSON to Deletions. With a
+// checkpoint, buffered output is flushed, so the record can be marked done.
+func (h *Harvester) writeDeletion(r result) error {
+	b, err := json.Marshal(JSONRecord{
+		Identifier: r.Header.Identifier,
+		Datestamp:  r.Header.DateStamp,
+		SetSpecs:   r.Header.SetSpec,
+		Status:     r.Header.Status,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := h.Deletions.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if f, ok := h.Deletions.(flusher); ok && h.Checkpoint != nil {
+		return f.Flush()
+	}
+	return nil
+}
+
+// identify returns the Identify response of the endpoint, requested once per
+// harvest. Callers arriving during the request wait for its outcome.
+func (h *Harvester) identify(ctx context.Context, client Fetcher) (*IdentifyResponse, error) {
+	h.identifyOnce.Do(func() {
+		c := &Client{Base: h.Base, Fetcher: client, Method: h.Method}
+		h.identity, h.identifyErr = c.Identify(ctx)
+	})
+	return h.identity, h.identifyErr
+}
+
+// tracksDeletions reports, whether the endpoint may forget deleted records,
+// as reported by Identify. A listed identifier, that does not exist, then
+// belongs to a record deleted meanwhile. An endpoint with persistent deletions
+// would return the record as deleted instead.
+func (h *Harvester) tracksDeletions(ctx context.Context, client Fetcher) bool {
+	ir, err := h.identify(ctx, client)
+	if err != nil {
+		log.Debug("cannot determine deleted record support: ", err)
+		return false
+	}
+	return ir.Identify.DeletedRecord == "transient"
+}
@@ -0,0 +1,140 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// jsonRecords decodes JSON output.
+func jsonRecords(t *testing.T, b []byte) (records []JSONRecord) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var rec JSONRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestParseDeletedPolicy(t *testing.T) {
+	for _, p := range []DeletedPolicy{DeletedTombstone, DeletedSkip, DeletedFile} {
+		got, err := ParseDeletedPolicy(p.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != p {
+			t.Errorf("got %v, want %v", got, p)
+		}
+	}
+	if _, err := ParseDeletedPolicy("keep"); err == nil {
+		t.Errorf("expected error for unknown policy")
+	}
+}
+
+func TestRunDeleted(t *testing.T) {
+	var cases = []struct {
+		strategy  Strategy
+		policy    DeletedPolicy
+		records   int
+		deletions int
+	}{
+		{StrategyPerRecord, DeletedTombstone, 10, 0},
+		{StrategyPerRecord, DeletedSkip, 8, 0},
+		{StrategyPerRecord, DeletedFile, 8, 2},
+		{StrategyListRecords, DeletedTombstone, 10, 0},
+		{StrategyListRecords, DeletedSkip, 8, 0},
+		{StrategyListRecords, DeletedFile, 8, 2},
+	}
+	for _, c := range cases {
+		repo := &testRepository{
+			Identifiers: testIdentifiers(10),
+			PageSize:    5,
+			Deleted:     map[string]bool{"oai:test:3": true, "oai:test:7": true},
+		}
+		ts := httptest.NewServer(repo)
+
+		var buf, deletions bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.OutputFormat = OutputJSON
+		h.Strategy = c.strategy
+		h.DeletedPolicy = c.policy
+		h.Deletions = &deletions
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		ts.Close()
+
+		records := jsonRecords(t, buf.Bytes())
+		if len(records) != c.records {
+			t.Errorf("%v, %v: got %d records, want %d", c.strategy, c.policy, len(records), c.records)
+		}
+		var tombstones int
+		for _, rec := range records {
+			if rec.Status == "deleted" {
+				tombstones++
+				if rec.Metadata != "" {
+					t.Errorf("tombstone with metadata: %v", rec)
+				}
+			}
+		}
+		if want := c.records - 8; tombstones != want {
+			t.Errorf("%v, %v: got %d tombstones, want %d", c.strategy, c.policy, tombstones, want)
+		}
+		if got := len(jsonRecords(t, deletions.Bytes())); got != c.deletions {
+			t.Errorf("%v, %v: got %d deletions, want %d", c.strategy, c.policy, got, c.deletions)
+		}
+		// Deleted records are not requested.
+		if c.strategy == StrategyPerRecord && repo.Requests("GetRecord") != 8 {
+			t.Errorf("got %d GetRecord requests, want 8", repo.Requests("GetRecord"))
+		}
+	}
+
+	h := NewHarvester("http://localhost")
+	h.DeletedPolicy = DeletedFile
+	if err := h.Run(); err == nil {
+		t.Errorf("expected error without Deletions writer")
+	}
+}
+
+func TestRunDeletedMeanwhile(t *testing.T) {
+	for _, support := range []string{"no", "transient", "persistent"} {
+		repo := &testRepository{
+			Identifiers:   testIdentifiers(10),
+			PageSize:      5,
+			Errors:        map[string]string{"oai:test:3": "idDoesNotExist", "oai:test:4": "idDoesNotExist"},
+			DeletedRecord: support,
+		}
+		ts := httptest.NewServer(repo)
+
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.OutputFormat = OutputJSON
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		ts.Close()
+
+		// Only an endpoint, which may forget deleted records, reports them
+		// this way.
+		var deleted int
+		records := jsonRecords(t, buf.Bytes())
+		for _, rec := range records {
+			if rec.Status == "deleted" {
+				deleted++
+			}
+		}
+		want := map[string]int{"no": 0, "transient": 2, "persistent": 0}[support]
+		if deleted != want || len(records) != 8+want {
+			t.Errorf("%s: got %d records, %d deleted, want %d deleted", support, len(records), deleted, want)
+		}
+		if n := repo.Requests("Identify"); n != 1 {
+			t.Errorf("%s: got %d Identify requests, want 1", support, n)
+		}
+	}
+}
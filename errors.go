@@ -0,0 +1,48 @@
+package oaicrawl
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProtocolError wraps an OAI protocol error together with the request URL.
+type ProtocolError struct {
+	URL string
+	Err OAIError
+}
+
+// Error reports URL, code and message.
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.URL, e.Err)
+}
+
+// Unwrap returns the underlying OAIError.
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// StatusError is returned, when an endpoint responds with an unexpected HTTP
+// status code.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter is the delay requested by the server, if any.
+	RetryAfter time.Duration
+}
+
+// Error reports URL and status code.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: http status %d", e.URL, e.StatusCode)
+}
+
+// DecodeError is returned, when a response cannot be parsed as OAI-PMH.
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+// Error reports URL and the decoding error.
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: decode: %s", e.URL, e.Err)
+}
+
+// Unwrap returns the underlying decoding error.
+func (e *DecodeError) Unwrap() error { return e.Err }
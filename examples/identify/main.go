@@ -13,10 +13,9 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"text/tabwriter"
 
@@ -24,15 +23,11 @@ import (
 )
 
 func main() {
-	resp, err := http.Get("http://export.arxiv.org/oai2?verb=Identify")
+	client := oaicrawl.NewClient("http://export.arxiv.org/oai2")
+	ir, err := client.Identify(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
-	var ir oaicrawl.IdentifyResponse
-	if err := xml.NewDecoder(resp.Body).Decode(&ir); err != nil {
-		log.Fatal(err)
-	}
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 0, '\t', 0)
 	defer w.Flush()
 	fmt.Fprintf(w, "response date\t%s\n", ir.ResponseDate)
@@ -11,25 +11,21 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 
 	"github.com/miku/oaicrawl"
 )
 
 func main() {
-	resp, err := http.Get("http://www.duo.uio.no/oai/request?verb=ListIdentifiers&metadataPrefix=oai_dc")
+	client := oaicrawl.NewClient("http://www.duo.uio.no/oai/request")
+	ctx := context.Background()
+	lir, err := client.ListIdentifiers(ctx, oaicrawl.ListOptions{MetadataPrefix: "oai_dc"})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
-	var lir oaicrawl.ListIdentifiersResponse
-	if err := xml.NewDecoder(resp.Body).Decode(&lir); err != nil {
-		log.Fatal(err)
-	}
 	for _, item := range lir.ListIdentifiers.Headers {
 		fmt.Printf("%s\n", item.Identifier)
 	}
@@ -42,19 +38,12 @@ func main() {
 			lir.ListIdentifiers.ResumptionToken.CompleteListSize)
 	}
 
-	// If there are more, assemble the next URL.
+	// If there are more, request the next page with the token.
 	token := lir.ListIdentifiers.ResumptionToken.Value
-	next := fmt.Sprintf("http://www.duo.uio.no/oai/request?verb=ListIdentifiers&resumptionToken=%s", token)
-
-	resp, err = http.Get(next)
+	lir, err = client.ListIdentifiers(ctx, oaicrawl.ListOptions{ResumptionToken: token})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
-
-	if err := xml.NewDecoder(resp.Body).Decode(&lir); err != nil {
-		log.Fatal(err)
-	}
 	for _, item := range lir.ListIdentifiers.Headers {
 		fmt.Printf("%s\n", item.Identifier)
 	}
@@ -24,25 +24,20 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"strings"
 
 	"github.com/miku/oaicrawl"
 )
 
 func main() {
-	resp, err := http.Get("http://export.arxiv.org/oai2?verb=ListSets")
+	client := oaicrawl.NewClient("http://export.arxiv.org/oai2")
+	lsr, err := client.ListSets(context.Background(), "")
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
-	var lsr oaicrawl.ListSetsResponse
-	if err := xml.NewDecoder(resp.Body).Decode(&lsr); err != nil {
-		log.Fatal(err)
-	}
 	var sets []string
 	for _, s := range lsr.ListSets.Sets {
 		sets = append(sets, fmt.Sprintf("%s (%s)", s.SetName, s.SetSpec))
@@ -11,10 +11,9 @@
 package main
 
 import (
-	"encoding/xml"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"time"
 
@@ -27,29 +26,15 @@ func main() {
 	// base := "http://zvdd.de/oai2"
 	// base := "http://oai.narcis.nl/oai"
 	base := "http://www.digizeitschriften.de/oai2/"
-	link := fmt.Sprintf("%s?verb=ListIdentifiers&metadataPrefix=oai_dc", base)
-	var items, requests int
-	var token string
-	for {
-		resp, err := http.Get(link)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer resp.Body.Close()
-		requests++
-		var lir oaicrawl.ListIdentifiersResponse
-		if err := xml.NewDecoder(resp.Body).Decode(&lir); err != nil {
-			log.Fatal(err)
-		}
-		for _, item := range lir.ListIdentifiers.Headers {
-			fmt.Println(item.Identifier)
-			items++
-		}
-		if token = lir.ListIdentifiers.ResumptionToken.Value; token == "" {
-			break
-		}
-		link = fmt.Sprintf("%s?verb=ListIdentifiers&resumptionToken=%s", base, token)
+	client := oaicrawl.NewClient(base)
+	it := client.Headers(context.Background(), oaicrawl.ListOptions{MetadataPrefix: "oai_dc"})
+	for it.Next() {
+		fmt.Println(it.Value().Identifier)
 	}
+	if err := it.Err(); err != nil {
+		log.Fatal(err)
+	}
+	p := it.Progress()
 	fmt.Fprintf(os.Stderr, "fetched %d identifiers with %d requests in %s\n",
-		items, requests, time.Since(started))
+		p.Items, p.Requests, time.Since(started))
 }
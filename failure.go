@@ -0,0 +1,98 @@
+package oaicrawl
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Failure describes a record, that could not be harvested. With a Failures
+// writer, a harvester writes one Failure per line as JSON, which NewReaderSource
+// accepts to retry the failed records.
+type Failure struct {
+	Identifier string `json:"identifier"`
+	URL        string `json:"url"`
+	// Class is one of protocol, http, decode or network.
+	Class string `json:"class"`
+	// Code is the OAI error code of protocol errors.
+	Code string `json:"code,omitempty"`
+	// StatusCode is the HTTP status of http errors.
+	StatusCode int       `json:"status,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+// newFailure describes a failed result.
+func newFailure(r result) Failure {
+	f := Failure{
+		Identifier: r.Identifier,
+		URL:        r.URL,
+		Class:      "network",
+		Attempts:   r.Attempts,
+		Error:      r.Err.Error(),
+		Time:       time.Now().UTC(),
+	}
+	switch err := r.Err.(type) {
+	case *ProtocolError:
+		f.Class, f.Code = "protocol", err.Err.Code
+	case *StatusError:
+		f.Class, f.StatusCode = "http", err.StatusCode
+	case *DecodeError:
+		f.Class = "decode"
+	}
+	return f
+}
+
+// writeFailure writes a failure as JSON to Failures.
+func (h *Harvester) writeFailure(f Failure) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = h.Failures.Write(append(b, '\n'))
+	return err
+}
+
+// failureSummary counts failures by class and code or status.
+type failureSummary map[string]int
+
+func (s failureSummary) add(f Failure) {
+	key := f.Class
+	switch {
+	case f.Code != "":
+		key += " " + f.Code
+	case f.StatusCode != 0:
+		key += fmt.Sprintf(" %d", f.StatusCode)
+	}
+	s[key]++
+}
+
+// total returns the number of failures.
+func (s failureSummary) total() (n int) {
+	for _, v := range s {
+		n += v
+	}
+	return n
+}
+
+// String lists the counts, most frequent first.
+func (s failureSummary) String() string {
+	var keys []string
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if s[keys[i]] != s[keys[j]] {
+			return s[keys[i]] > s[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%d %s", s[k], k))
+	}
+	return strings.Join(parts, ", ")
+}
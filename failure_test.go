@@ -0,0 +1,78 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunFailures(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(10),
+		PageSize:    10,
+		Errors: map[string]string{
+			"oai:test:2": "cannotDisseminateFormat",
+			"oai:test:5": "cannotDisseminateFormat",
+		},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var failures bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = ioutil.Discard
+	h.BestEffort = true
+	h.MaxElapsedTime = 50 * time.Millisecond
+	h.Failures = &failures
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(failures.Bytes()))
+	got := make(map[string]Failure)
+	for dec.More() {
+		var f Failure
+		if err := dec.Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		got[f.Identifier] = f
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d failures, want 2", len(got))
+	}
+	for _, id := range []string{"oai:test:2", "oai:test:5"} {
+		f := got[id]
+		if f.Class != "protocol" || f.Code != "cannotDisseminateFormat" {
+			t.Errorf("%s: got class %q, code %q", id, f.Class, f.Code)
+		}
+		if f.Attempts < 1 || f.URL == "" || f.Time.IsZero() || f.Error == "" {
+			t.Errorf("%s: incomplete failure: %+v", id, f)
+		}
+	}
+
+	// The failure log can be used to retry the failed records.
+	repo.Errors = nil
+	before := repo.Requests("GetRecord")
+	h.Failures = nil
+	h.Identifiers = NewReaderSource(&failures)
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := repo.Requests("GetRecord") - before; n != 2 {
+		t.Errorf("got %d GetRecord requests, want 2", n)
+	}
+}
+
+func TestFailureSummary(t *testing.T) {
+	s := make(failureSummary)
+	s.add(Failure{Class: "http", StatusCode: 500})
+	s.add(Failure{Class: "protocol", Code: "badArgument"})
+	s.add(Failure{Class: "http", StatusCode: 500})
+	s.add(Failure{Class: "network"})
+	if got, want := s.String(), "2 http 500, 1 network, 1 protocol badArgument"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
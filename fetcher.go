@@ -0,0 +1,251 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+)
+
+// Fetcher performs HTTP requests. It is satisfied by *http.Client, so proxies,
+// TLS configuration, cookies or a custom transport can be used for a harvest.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// NewRetryFetcher wraps an HTTP client and retries requests on network errors
+// with exponential backoff, like the default fetcher. Responses are returned
+// whatever their status, so server errors and Retry-After are left to the
+// caller.
+func NewRetryFetcher(hc *http.Client, maxRetries int) Fetcher {
+	return &retryFetcher{Fetcher: hc, maxRetries: maxRetries, name: "fetcher"}
+}
+
+// workerFetcher returns the default fetcher for GetRecord requests.
+func (h *Harvester) workerFetcher(name string) Fetcher {
+	hc := &http.Client{Timeout: 5 * time.Second}
+	return &retryFetcher{Fetcher: hc, maxRetries: h.MaxRetries, name: name}
+}
+
+// listFetcher returns the default fetcher for list and Identify requests.
+func (h *Harvester) listFetcher() Fetcher {
+	return &retryFetcher{Fetcher: &http.Client{}, maxRetries: h.MaxRetries, name: "main client"}
+}
+
+// inside applies wrap to client below its retries, if it retries requests
+// like the default fetcher, so each attempt passes through the wrapper.
+func inside(client Fetcher, wrap func(Fetcher) Fetcher) Fetcher {
+	if f, ok := client.(*retryFetcher); ok {
+		return &retryFetcher{Fetcher: wrap(f.Fetcher), maxRetries: f.maxRetries, name: f.name}
+	}
+	return wrap(client)
+}
+
+// retryFetcher retries requests on network errors, waiting 1, 2, 4, ...
+// seconds between attempts.
+type retryFetcher struct {
+	Fetcher
+	maxRetries int
+	name       string
+}
+
+// Do performs the request up to maxRetries+1 times. Requests with a body are
+// only retried, if the body can be recreated.
+func (f *retryFetcher) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for i := 0; ; i++ {
+		r := req
+		if i > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.WithContext(ctx)
+			r.Body = body
+		}
+		resp, err := f.Fetcher.Do(r)
+		if err == nil || i >= f.maxRetries || ctx.Err() != nil || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		s := req.URL.String()
+		if len(s) > 45 {
+			s = ".." + s[len(s)-45:]
+		}
+		log.Warn(f.name, " backoff [", i+1, "]: ", s, ": ", err)
+		select {
+		case <-time.After(time.Duration(1<<uint(i)) * time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// response is implemented by all OAI-PMH response types.
+type response interface {
+	oaiError() OAIError
+}
+
+// fetch requests link and decodes the response into v. HTTP status codes other
+// than 200 and OAI protocol errors are returned as errors.
+func fetch(ctx context.Context, client Fetcher, link string, v response) error {
+	b, err := fetchBody(ctx, client, link)
+	if err != nil {
+		return err
+	}
+	return decode(link, b, v)
+}
+
+// fetchBody requests link and returns the body of a successful response. On
+// server errors, it retries a few times, waiting as long as the server asks
+// for, if it does.
+func fetchBody(ctx context.Context, client Fetcher, link string) ([]byte, error) {
+	for i := 0; ; i++ {
+		req, err := http.NewRequest("GET", link, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := doContext(ctx, client, req)
+		if err != nil {
+			return nil, err
+		}
+		serr := statusError(link, resp)
+		if serr == nil {
+			defer resp.Body.Close()
+			return ioutil.ReadAll(resp.Body)
+		}
+		resp.Body.Close()
+		delay := serr.RetryAfter
+		if delay == 0 && (serr.StatusCode >= 500 || serr.StatusCode == http.StatusTooManyRequests) {
+			delay = time.Duration(1<<uint(i)) * time.Second
+		}
+		if delay == 0 || i == maxStatusRetries {
+			return nil, serr
+		}
+		log.Warn(link, ": http status ", serr.StatusCode, ", retrying after ", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// maxStatusRetries limits the number of retries of list requests on server
+// errors.
+const maxStatusRetries = 3
+
+// maxRetryAfter caps the delay requested by a server.
+const maxRetryAfter = 10 * time.Minute
+
+// statusError returns a *StatusError for responses other than 200 OK. For 503
+// Service Unavailable and 429 Too Many Requests, it includes the delay
+// requested by the server, if any.
+func statusError(link string, resp *http.Response) *StatusError {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	err := &StatusError{URL: link, StatusCode: resp.StatusCode}
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		err.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+	}
+	return err
+}
+
+// retryAfter parses the value of a Retry-After header, which may be a number
+// of seconds or a HTTP date. It returns zero, if there is no usable value.
+func retryAfter(value string) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	}
+	switch {
+	case d < 0:
+		return 0
+	case d > maxRetryAfter:
+		return maxRetryAfter
+	default:
+		return d
+	}
+}
+
+// retryAfterBackOff prefers the delay requested by the server over the
+// wrapped backoff policy, for a limited number of times.
+type retryAfterBackOff struct {
+	backoff.BackOff
+	delay     time.Duration
+	remaining int
+}
+
+// NextBackOff returns the delay requested by the last response, if any.
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	if b.delay > 0 && b.remaining > 0 {
+		d := b.delay
+		b.delay = 0
+		b.remaining--
+		return d
+	}
+	return b.BackOff.NextBackOff()
+}
+
+// decode parses the response to link into v and returns OAI protocol errors.
+func decode(link string, b []byte, v response) error {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	if err := dec.Decode(v); err != nil {
+		return &DecodeError{URL: link, Err: err}
+	}
+	if e := v.oaiError(); e.Code != "" {
+		return &ProtocolError{URL: link, Err: e}
+	}
+	return nil
+}
+
+// isNoRecordsMatch reports, whether err signals an empty list.
+func isNoRecordsMatch(err error) bool {
+	perr, ok := err.(*ProtocolError)
+	return ok && perr.Err.Code == "noRecordsMatch"
+}
+
+// listIdentifiers fetches and decodes a single ListIdentifiers page.
+func listIdentifiers(ctx context.Context, client Fetcher, link string) (*ListIdentifiersResponse, error) {
+	var lir ListIdentifiersResponse
+	if err := fetch(ctx, client, link, &lir); err != nil && !isNoRecordsMatch(err) {
+		return nil, err
+	}
+	return &lir, nil
+}
+
+// doContext performs a request, but returns as soon as ctx is done, since a
+// custom fetcher may not interrupt its own retry backoff. A response
+// arriving after cancellation is closed.
+func doContext(ctx context.Context, client Fetcher, req *http.Request) (*http.Response, error) {
+	type response struct {
+		resp *http.Response
+		err  error
+	}
+	ch := make(chan response, 1)
+	go func() {
+		resp, err := client.Do(req.WithContext(ctx))
+		ch <- response{resp, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.resp != nil {
+				r.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,103 @@
+package oaicrawl
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// headerTransport sets a header on each request and counts requests.
+type headerTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	r := new(http.Request)
+	*r = *req
+	r.Header = http.Header{"Authorization": {"Bearer secret"}}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestFetcher(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(15), PageSize: 10}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, fetcher := range []func(*http.Client) Fetcher{
+		func(hc *http.Client) Fetcher { return hc },
+		func(hc *http.Client) Fetcher { return NewRetryFetcher(hc, 3) },
+	} {
+		transport := &headerTransport{}
+		h := NewHarvester(ts.URL)
+		h.Output = ioutil.Discard
+		h.Fetcher = fetcher(&http.Client{Transport: transport})
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if transport.requests != 17 {
+			t.Errorf("got %d requests through fetcher, want 17", transport.requests)
+		}
+	}
+
+	// Without credentials, the endpoint fails fast.
+	h := NewHarvester(ts.URL)
+	h.Output = ioutil.Discard
+	h.Fetcher = http.DefaultClient
+	if err, ok := h.Run().(*StatusError); !ok || err.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v, want status 401", err)
+	}
+}
+
+// flakyTransport fails the first requests with a network error.
+type flakyTransport struct {
+	mu       sync.Mutex
+	failures int
+	requests int
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	fail := t.requests <= t.failures
+	t.mu.Unlock()
+	if fail {
+		return nil, errors.New("connection reset")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRetryFetcher(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	transport := &flakyTransport{failures: 1}
+	f := NewRetryFetcher(&http.Client{Transport: transport}, 3)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := f.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// The network error is retried, the server error is left to the caller.
+	if resp.StatusCode != http.StatusServiceUnavailable || transport.requests != 2 {
+		t.Errorf("got status %d after %d requests, want 503 after 2", resp.StatusCode, transport.requests)
+	}
+}
@@ -4,7 +4,7 @@ go 1.12
 
 require (
 	github.com/cenkalti/backoff v1.1.0
-	github.com/sethgrid/pester v0.0.0-20170816164208-a86a2d88f4dc
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/sirupsen/logrus v1.0.3
 	golang.org/x/crypto v0.0.0-20170912191825-faadfbdc0353
 	golang.org/x/net v0.0.0-20170912211736-b129b8e0fbeb
@@ -2,20 +2,30 @@ package oaicrawl
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/sethgrid/pester"
 	log "github.com/sirupsen/logrus"
 )
 
+// Datestamp granularities defined by OAI-PMH.
+const (
+	GranularityDay    = "YYYY-MM-DD"
+	GranularitySecond = "YYYY-MM-DDThh:mm:ssZ"
+)
+
 // Harvester encapsulates harvesting options.
 type Harvester struct {
 	Base           string
@@ -26,11 +36,74 @@ type Harvester struct {
 	Verbose        bool
 	BestEffort     bool
 	Output         io.Writer
+	OutputFormat   OutputFormat
+
+	// From and Until restrict the harvest to records changed in this
+	// interval, if not zero.
+	From  time.Time
+	Until time.Time
+	// Granularity of From and Until, if empty, it is taken from the Identify
+	// response of the endpoint.
+	Granularity string
+	// Sets restricts the harvest to records in one of these sets.
+	Sets []string
+	// FilterSets lists all identifiers and filters them by set spec instead
+	// of passing sets to the endpoint, for endpoints with a broken set
+	// parameter.
+	FilterSets bool
+	// Strategy determines, whether records are requested one by one or in
+	// batches.
+	Strategy Strategy
+	// Fetcher performs all HTTP requests, if set. By default, requests are
+	// retried on network and server errors with exponential backoff.
+	Fetcher Fetcher
+	// Method is the HTTP method of requests, GET or POST. GET requests
+	// rejected as too long are sent again as POST.
+	Method string
+	// RateLimit limits all requests of the harvest to this many requests per
+	// second, allowing bursts of Burst requests, if not zero.
+	RateLimit float64
+	Burst     int
+	// MinDelay is the minimum time between the start of two requests.
+	MinDelay time.Duration
+	// Adaptive starts with few concurrent GetRecord requests and adapts
+	// their number to latency and errors of the endpoint, up to NumWorkers.
+	Adaptive bool
+	// Checkpoint, if set, records progress and allows to resume a harvest.
+	Checkpoint *Checkpoint
+	// Identifiers, if set, provides the identifiers to harvest, instead of
+	// listing them. Sets, From and Until are ignored then.
+	Identifiers IdentifierSource
+	// Failures receives a Failure for each record, that could not be
+	// harvested, as one JSON object per line.
+	Failures io.Writer
+	// Stats counts the records of the last run, once it returned.
+	Stats Stats
+	// DeletedPolicy determines, whether deleted records are written to
+	// Output, to Deletions or skipped. A RecordStore as Output receives
+	// deleted records with any policy.
+	DeletedPolicy DeletedPolicy
+	// Deletions receives deleted records with DeletedFile, as one JSON
+	// object per line.
+	Deletions io.Writer
 
 	wg      sync.WaitGroup
 	queue   chan work
 	results chan result
-	done    chan bool
+	done    chan error
+	// sink receives HTTP exchanges, if they are recorded.
+	sink *exchangeSink
+	// limiter is shared by all requests, if rate limited.
+	limiter *limiter
+	// controller limits concurrent GetRecord requests, if adaptive.
+	controller *controller
+
+	// base is the parsed Base of the current run.
+	base *url.URL
+
+	identifyOnce *sync.Once
+	identity     *IdentifyResponse
+	identifyErr  error
 }
 
 // NewHarvester creates a new harvester for an endpoint with default options.
@@ -39,7 +112,8 @@ func NewHarvester(base string) *Harvester {
 		Base:           base,
 		Format:         "oai_dc",
 		MaxElapsedTime: 10 * time.Second,
-		MaxRetries:     3,
+		MaxRetries:     defaultMaxRetries,
+		Method:         http.MethodGet,
 		NumWorkers:     4 * runtime.NumCPU(),
 		Output:         os.Stdout,
 	}
@@ -50,66 +124,140 @@ type work struct {
 }
 
 type result struct {
-	Body []byte
-	Err  error
+	Identifier string
+	URL        string
+	Body       []byte
+	Err        error
+	// Header of the record, if available.
+	Header Header
+	// Missing is set for listed identifiers, that do not exist.
+	Missing bool
+	// Attempts is the number of requests made for the record.
+	Attempts int
+	// Exchange is set for recorded HTTP exchanges, which are not records.
+	Exchange *exchange
+}
+
+// Stats counts the outcome of a harvest.
+type Stats struct {
+	// Written records, including deleted records written to Output.
+	Written int `json:"written"`
+	Deleted int `json:"deleted"`
+	// Missing are listed records, that could not be found.
+	Missing int `json:"missing"`
+	Failed  int `json:"failed"`
+}
+
+// headerResponse is a GetRecord response with only the record header decoded.
+type headerResponse struct {
+	GenericResponse
+	GetRecord struct {
+		Record struct {
+			Header Header `xml:"header"`
+		} `xml:"record"`
+	}
+}
+
+// RecordStore is implemented by outputs, which store each record separately
+// instead of writing a stream, e.g. DirStore. The harvester passes each record
+// with its header to Put instead of calling Write.
+type RecordStore interface {
+	Put(header Header, b []byte) error
+}
+
+// flusher is implemented by buffered outputs, e.g. bufio.Writer.
+type flusher interface {
+	Flush() error
 }
 
 // worker takes an item of the queue of work items, fetches the content, retries
-// on various errors and sends the result to the output.
-func (h *Harvester) worker(name string) {
+// on various errors and sends the result to the output. Requests and retries
+// are abandoned, once ctx is cancelled.
+func (h *Harvester) worker(ctx context.Context, name string) {
 	defer h.wg.Done()
 
 	log.Debug(name, " started")
 
-	client := pester.New()
-	client.Timeout = 5 * time.Second
-	client.MaxRetries = h.MaxRetries
-	client.Backoff = pester.ExponentialBackoff
-	client.LogHook = func(e pester.ErrEntry) {
-		s := e.URL
-		if len(s) > 45 {
-			s = ".." + s[len(s)-45:]
-		}
-		log.Warn(name, " backoff [", e.Attempt, "]: ", s)
+	client := h.Fetcher
+	if client == nil {
+		client = h.workerFetcher(name)
 	}
+	client = h.wrap(client, h.controller)
 
 	var i int
 	for item := range h.queue {
-		link := fmt.Sprintf("%s?verb=GetRecord&identifier=%s&metadataPrefix=%s",
-			h.Base, item.Identifier, h.Format)
+		link := requestLink(h.base, url.Values{
+			"verb":           {"GetRecord"},
+			"identifier":     {item.Identifier},
+			"metadataPrefix": {h.Format},
+		})
 
+		// Retry op on HTTP, XML decoding or oai protocol errors.
+		eb := backoff.NewExponentialBackOff()
+		eb.MaxElapsedTime = h.MaxElapsedTime
+		rb := &retryAfterBackOff{BackOff: eb, remaining: h.MaxRetries}
+
+		var attempts int
 		op := func() error {
+			attempts++
 			// Fetch link.
-			resp, err := client.Get(link)
+			req, err := http.NewRequest("GET", link, nil)
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			resp, err := doContext(ctx, client, req)
 			if err != nil {
 				return err
 			}
 			defer resp.Body.Close()
+
+			// Wait as long as the server asks for on 503 and 429, retry other
+			// server errors, but do not retry on client errors.
+			if err := statusError(link, resp); err != nil {
+				switch {
+				case err.RetryAfter > 0:
+					rb.delay = err.RetryAfter
+				case err.StatusCode == http.StatusTooManyRequests:
+					// Retry with backoff.
+				case err.StatusCode >= 400 && err.StatusCode < 500:
+					return backoff.Permanent(err)
+				}
+				return err
+			}
 			b, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				return err
 			}
+			// Release the connection, since a limited fetcher may need it
+			// for the Identify request below.
+			resp.Body.Close()
 
 			// Check for OAI protocol errors.
-			var generic GenericResponse
+			var generic headerResponse
 			dec := xml.NewDecoder(bytes.NewReader(b))
 			dec.Strict = false
 			if err := dec.Decode(&generic); err != nil {
-				return err
+				return &DecodeError{URL: link, Err: err}
 			}
 			if generic.Error.Code != "" {
 				switch generic.Error.Code {
-				// Do not treat missing id as an error.
+				// Do not treat missing id as an error. If the endpoint
+				// keeps track of deletions, the record was deleted.
 				case "idDoesNotExist":
+					if h.tracksDeletions(ctx, client) {
+						h.results <- h.tombstone(Header{Identifier: item.Identifier}, link)
+						return nil
+					}
 					log.Debug("skipping id ", item.Identifier)
+					h.results <- result{Identifier: item.Identifier, URL: link, Missing: true}
 					return nil
 				default:
-					return fmt.Errorf("%s oai error [%s]: %s %s", link,
-						name, generic.Error.Code, generic.Error.Message)
+					return &ProtocolError{URL: link, Err: generic.Error}
 				}
 			}
 
-			h.results <- result{Body: b}
+			h.results <- result{Identifier: item.Identifier, URL: link, Body: b,
+				Header: generic.GetRecord.Record.Header}
 
 			i++
 			if i%100 == 0 {
@@ -118,107 +266,554 @@ func (h *Harvester) worker(name string) {
 			return nil
 		}
 
-		// Retry op on HTTP, XML decoding or oai protocol errors.
-		eb := backoff.NewExponentialBackOff()
-		eb.MaxElapsedTime = h.MaxElapsedTime
-		err := backoff.RetryNotify(op, eb, func(err error, _ time.Duration) {
+		err := backoff.RetryNotify(op, backoff.WithContext(rb, ctx), func(err error, _ time.Duration) {
 			log.Warn(fmt.Sprintf("%s retry reason: %s", name, err))
 		})
 
+		// A cancelled request is not a failure of the endpoint.
+		if ctx.Err() != nil {
+			log.Debug(name, " abandoned ", item.Identifier)
+			continue
+		}
+
 		// Finally, if we still encounter an error, report it.
 		if err != nil {
-			h.results <- result{Err: err}
+			h.results <- result{Identifier: item.Identifier, URL: link, Err: err, Attempts: attempts}
 		}
 	}
 	log.Debug(name, " shut down")
 }
 
-// write collects data from the output channel and writes it to the configured writer.
-func (h *Harvester) write() {
-	var i int
+// write collects data from the output channel and writes it to the configured
+// writer. Unless in best effort mode, the first error stops the harvest by
+// calling cancel. Remaining results are drained and the first error is
+// reported on the done channel.
+func (h *Harvester) write(cancel context.CancelFunc, started time.Time) {
+	var (
+		i, deleted, missing int
+		firstErr            error
+		failures            = make(failureSummary)
+	)
+	footer, err := h.begin(started)
+	if err != nil {
+		firstErr = err
+		cancel()
+	}
 	for r := range h.results {
+		if firstErr != nil {
+			continue
+		}
+		if r.Exchange != nil {
+			if err := h.writeExchange(r.Exchange); err != nil {
+				firstErr = err
+				cancel()
+			}
+			continue
+		}
+		if r.Missing {
+			missing++
+			if err := h.markDone(r.Identifier, nil); err != nil {
+				firstErr = err
+				cancel()
+			}
+			continue
+		}
+		if r.Err == nil && isDeleted(r.Header) {
+			deleted++
+			// A record store gets deleted records anyway, to remove them.
+			_, store := h.Output.(RecordStore)
+			var err error
+			switch h.DeletedPolicy {
+			case DeletedSkip:
+				if !store {
+					err = h.markDone(r.Identifier, nil)
+				}
+			case DeletedFile:
+				if err = h.writeDeletion(r); err == nil && !store {
+					err = h.markDone(r.Identifier, nil)
+				}
+			}
+			if err != nil {
+				firstErr = err
+				cancel()
+				continue
+			}
+			if h.DeletedPolicy != DeletedTombstone && !store {
+				continue
+			}
+		}
+		if r.Err == nil {
+			r.Body, r.Err = h.encode(r)
+		}
 		if r.Err != nil {
+			f := newFailure(r)
+			failures.add(f)
+			if h.Checkpoint != nil {
+				if err := h.Checkpoint.markFailed(r.Identifier); err != nil {
+					log.Warn(err)
+				}
+			}
+			if h.Failures != nil {
+				if err := h.writeFailure(f); err != nil {
+					log.Warn(err)
+				}
+			}
 			if h.BestEffort {
-				log.Warn(r.Err)
-			} else {
-				log.Fatal(r.Err)
+				log.WithField("identifier", r.Identifier).Warn(r.Err)
+				continue
 			}
+			firstErr = r.Err
+			cancel()
+			continue
 		}
-		if _, err := h.Output.Write(r.Body); err != nil {
-			log.Fatal(err)
+		if err := h.writeRecord(r); err != nil {
+			firstErr = err
+			cancel()
+			continue
 		}
 		i++
 		if i%1000 == 0 {
 			log.Debug("writer: written ", i, " records")
 		}
 	}
-	h.done <- true
+	if len(footer) > 0 {
+		if _, err := h.Output.Write(footer); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(failures) > 0 {
+		log.Warn("failed records: ", failures)
+	}
+	if deleted > 0 || missing > 0 {
+		log.Info(fmt.Sprintf("%d deleted records (%s), %d listed records not found",
+			deleted, h.DeletedPolicy, missing))
+	}
+	h.Stats = Stats{Written: i, Deleted: deleted, Missing: missing, Failed: failures.total()}
+	h.done <- firstErr
+}
+
+// writeRecord writes a single result to Output. With a checkpoint, buffered
+// output is flushed first, so a record is never marked done before it has
+// been written.
+func (h *Harvester) writeRecord(r result) error {
+	if store, ok := h.Output.(RecordStore); ok {
+		header := r.Header
+		if header.Identifier == "" {
+			header.Identifier = r.Identifier
+		}
+		if err := store.Put(header, r.Body); err != nil {
+			return err
+		}
+	} else if _, err := h.Output.Write(r.Body); err != nil {
+		return err
+	}
+	return h.markDone(r.Identifier, h.Output)
+}
+
+// markDone marks a record done in the checkpoint, if any, after flushing the
+// writer it was written to, if buffered. Outputs completing their data later
+// mark it done, once complete.
+func (h *Harvester) markDone(id string, w io.Writer) error {
+	if h.Checkpoint == nil {
+		return nil
+	}
+	if c, ok := w.(committer); ok {
+		return c.Commit(func() error { return h.Checkpoint.markDone(id) })
+	}
+	if f, ok := w.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return h.Checkpoint.markDone(id)
+}
+
+// writeExchange writes a recorded HTTP exchange to Output.
+func (h *Harvester) writeExchange(e *exchange) error {
+	b, err := encodeExchange(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.Output.Write(b)
+	return err
+}
+
+// wrap adds the request method, rate limiting, concurrency control, if c is
+// not nil, and recording of exchanges to a fetcher, as configured. Rate
+// limiting, concurrency control and recording apply to each attempt of a
+// retrying fetcher and to requests sent again as POST.
+func (h *Harvester) wrap(client Fetcher, c *controller) Fetcher {
+	client = inside(client, func(client Fetcher) Fetcher {
+		if h.sink != nil {
+			client = &recorder{Fetcher: client, sink: h.sink}
+		}
+		if c != nil {
+			client = &adaptiveFetcher{Fetcher: client, controller: c}
+		}
+		if h.limiter != nil {
+			client = &limitedFetcher{Fetcher: client, limiter: h.limiter}
+		}
+		return client
+	})
+	return &methodFetcher{Fetcher: client, post: h.Method == http.MethodPost}
+}
+
+// enqueue sends an identifier to the workers and reports false, if ctx is
+// done first.
+func (h *Harvester) enqueue(ctx context.Context, id string) bool {
+	select {
+	case h.queue <- work{Identifier: id}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // Run starts the harvest with the given parameters.
 func (h *Harvester) Run() error {
+	return h.RunContext(context.Background())
+}
+
+// RunContext starts the harvest with the given parameters. When ctx is
+// cancelled, no more identifiers are queued, in-flight requests are abandoned
+// and all records fetched so far are written to Output before RunContext
+// returns the context error.
+//
+// Any other failure stops the harvest as well, workers and writer are shut
+// down and the error is returned, typically as a *ProtocolError, *StatusError
+// or *DecodeError. In best effort mode, failed records are only logged.
+//
+// With a Checkpoint, outstanding identifiers of a previous run are fetched
+// again and listing continues at the last recorded resumption token, skipping
+// identifiers seen before. If the token has expired, listing restarts from
+// the beginning.
+func (h *Harvester) RunContext(parent context.Context) error {
 	started := time.Now()
 
+	if h.DeletedPolicy == DeletedFile && h.Deletions == nil {
+		return errors.New("deleted policy file requires a Deletions writer")
+	}
+	if err := checkMethod(h.Method); err != nil {
+		return err
+	}
+	base, err := url.Parse(h.Base)
+	if err != nil {
+		return err
+	}
+	h.base = base
+	h.identifyOnce, h.identity, h.identifyErr = new(sync.Once), nil, nil
+
+	if h.Checkpoint != nil {
+		if err := h.Checkpoint.begin(h.Base, h.Format); err != nil {
+			return err
+		}
+	}
+
+	client := h.Fetcher
+	if client == nil {
+		client = h.listFetcher()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
 	h.queue = make(chan work)
 	h.results = make(chan result)
-	h.done = make(chan bool)
+	h.done = make(chan error)
+
+	h.sink = nil
+	if h.OutputFormat == OutputWARC {
+		h.sink = &exchangeSink{results: h.results}
+	}
+	h.limiter = nil
+	if h.RateLimit > 0 || h.MinDelay > 0 {
+		h.limiter = newLimiter(h.RateLimit, h.Burst, h.MinDelay)
+	}
+	h.controller = nil
+	if h.Adaptive {
+		h.controller = newController(h.NumWorkers)
+	}
+	client = h.wrap(client, nil)
 
 	for i := 0; i < h.NumWorkers; i++ {
 		h.wg.Add(1)
-		go h.worker(fmt.Sprintf("worker-%02d", i))
+		go h.worker(ctx, fmt.Sprintf("worker-%02d", i))
 	}
 
-	go h.write()
+	go h.write(cancel, started)
+
+	var (
+		items, requests int
+		listErr         error
+	)
 
-	link := fmt.Sprintf("%s?verb=ListIdentifiers&metadataPrefix=%s", h.Base, h.Format)
-	var items, requests int
+	if h.Checkpoint != nil {
+		outstanding := h.Checkpoint.Outstanding()
+		if len(outstanding) > 0 || h.Checkpoint.Len() > 0 {
+			log.Info("resuming harvest with ", h.Checkpoint.Len(), " records done, ",
+				len(outstanding), " outstanding")
+		}
+		for _, id := range outstanding {
+			if !h.enqueue(ctx, id) {
+				break
+			}
+			items++
+		}
+	}
 
-	client := pester.New()
-	client.MaxRetries = h.MaxRetries
-	client.Backoff = pester.ExponentialBackoff
-	client.LogHook = func(e pester.ErrEntry) {
-		log.Warn("main client: ", e)
+	// Records may belong to more than one of the requested sets or may be
+	// listed again after a strategy switch, fetch them only once. A checkpoint
+	// keeps track of seen identifiers itself.
+	var seen map[string]bool
+	if (len(h.listedSets()) > 1 || h.Strategy == StrategyAuto ||
+		h.Strategy == StrategyHybrid || h.Identifiers != nil) && h.Checkpoint == nil {
+		seen = make(map[string]bool)
 	}
 
+	var n, r int
+	if h.Identifiers != nil {
+		n, err = h.queueSource(ctx, seen)
+	} else {
+		n, r, err = h.list(ctx, client, seen)
+	}
+	items += n
+	requests += r
+	if err != nil && ctx.Err() == nil {
+		listErr = err
+	}
+
+	log.Debug("shutting down workers")
+
+	close(h.queue)
+	h.wg.Wait()
+	if h.sink != nil {
+		h.sink.close()
+	}
+	close(h.results)
+	writeErr := <-h.done
+
+	log.Debug("fetched ", items, " identifiers with ",
+		requests, " requests in ", time.Since(started))
+
+	switch {
+	case listErr != nil:
+		return listErr
+	case writeErr != nil:
+		return writeErr
+	default:
+		return parent.Err()
+	}
+}
+
+// list harvests the records of all requested sets. It returns the number of
+// harvested or queued records and list requests.
+func (h *Harvester) list(ctx context.Context, client Fetcher, seen map[string]bool) (items, requests int, err error) {
+	// The writer is already running, so the Identify request can be recorded.
+	granularity, err := h.granularity(ctx, client)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, set := range h.listedSets() {
+		if ctx.Err() != nil {
+			return items, requests, ctx.Err()
+		}
+		n, r, err := h.harvestSet(ctx, client, set, granularity, seen)
+		items += n
+		requests += r
+		if err != nil {
+			return items, requests, err
+		}
+	}
+	return items, requests, nil
+}
+
+// listedSets returns the set specs to list identifiers for, where an empty
+// spec means all identifiers.
+func (h *Harvester) listedSets() []string {
+	if len(h.Sets) == 0 || h.FilterSets {
+		return []string{""}
+	}
+	return h.Sets
+}
+
+// accept reports, whether a header belongs to the harvest. It only filters, if
+// sets are requested and the endpoint cannot be trusted to filter them
+// itself. Like a set parameter, a set spec includes its subsets.
+func (h *Harvester) accept(header Header) bool {
+	if !h.FilterSets || len(h.Sets) == 0 {
+		return true
+	}
+	for _, spec := range header.SetSpec {
+		for _, set := range h.Sets {
+			if spec == set || strings.HasPrefix(spec, set+":") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listSet queues the identifiers of a set, or of the whole repository if set
+// is empty, skipping identifiers seen before. Listing starts at token, if not
+// empty, or from the start, if the token has expired. It returns the number of
+// queued identifiers and ListIdentifiers requests.
+func (h *Harvester) listSet(ctx context.Context, client Fetcher, set, granularity, token string,
+	seen map[string]bool) (items, requests int, err error) {
+	first := h.listLink("ListIdentifiers", set, granularity)
+	link := first
+	resumed := token != ""
+	if resumed {
+		link = h.tokenLink("ListIdentifiers", token)
+	}
 	for {
 		log.Debug(link)
-		resp, err := client.Get(link)
+		lir, err := listIdentifiers(ctx, client, link)
 		if err != nil {
-			log.Fatal(err)
+			if perr, ok := err.(*ProtocolError); ok && resumed && perr.Err.Code == "badResumptionToken" {
+				log.Warn("resumption token expired, listing identifiers from the start")
+				link, resumed = first, false
+				continue
+			}
+			return items, requests, err
 		}
-		defer resp.Body.Close()
+		resumed = false
 		requests++
-		var lir ListIdentifiersResponse
-
-		dec := xml.NewDecoder(resp.Body)
-		dec.Strict = false
-		if err := dec.Decode(&lir); err != nil {
-			log.Fatal(err)
-		}
-		for _, item := range lir.ListIdentifiers.Headers {
-			h.queue <- work{Identifier: item.Identifier}
-			items++
+		n, err := h.queueHeaders(ctx, lir.ListIdentifiers.Headers, seen)
+		items += n
+		if err != nil {
+			return items, requests, err
 		}
 		token := lir.ListIdentifiers.ResumptionToken
+		if err := h.markList("ListIdentifiers", set, token.Value); err != nil {
+			return items, requests, err
+		}
 		if token.Value == "" {
-			break
+			return items, requests, nil
 		}
-		link = fmt.Sprintf("%s?verb=ListIdentifiers&resumptionToken=%s", h.Base, token.Value)
+		link = h.tokenLink("ListIdentifiers", token.Value)
 		if requests%10 == 0 {
 			log.Debug("completed ", requests, " ListIdentifier requests ",
 				items, "/", token.Cursor, "/", token.CompleteListSize)
 		}
 	}
+}
 
-	log.Debug("shutting down workers")
+// queueHeaders queues the identifiers of headers, which have not been seen
+// before, and returns the number of queued identifiers.
+func (h *Harvester) queueHeaders(ctx context.Context, headers []Header, seen map[string]bool) (n int, err error) {
+	for _, header := range headers {
+		ok, err := h.admit(header, seen)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		// Deleted records have no content, there is no need to request them.
+		if isDeleted(header) {
+			select {
+			case h.results <- h.tombstone(header, ""):
+			case <-ctx.Done():
+				return n, ctx.Err()
+			}
+			n++
+			continue
+		}
+		if !h.enqueue(ctx, header.Identifier) {
+			return n, ctx.Err()
+		}
+		n++
+	}
+	return n, nil
+}
 
-	close(h.queue)
-	h.wg.Wait()
-	close(h.results)
-	<-h.done
+// admit reports, whether a record should be harvested, because it belongs to
+// the harvest and has not been seen before. Admitted identifiers are recorded
+// as seen and queued in the checkpoint.
+func (h *Harvester) admit(header Header, seen map[string]bool) (bool, error) {
+	if !h.accept(header) {
+		return false, nil
+	}
+	return h.admitIdentifier(header.Identifier, seen)
+}
 
-	log.Debug("fetched ", items, " identifiers with ",
-		requests, " requests in ", time.Since(started))
+// admitIdentifier reports, whether an identifier has not been seen before and
+// records it as seen and queued.
+func (h *Harvester) admitIdentifier(id string, seen map[string]bool) (bool, error) {
+	if seen[id] {
+		return false, nil
+	}
+	if seen != nil {
+		seen[id] = true
+	}
+	if h.Checkpoint != nil {
+		if h.Checkpoint.Seen(id) {
+			return false, nil
+		}
+		if err := h.Checkpoint.markQueued(id); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// granularity returns the granularity for From and Until. If it is not
+// configured, it is requested from the endpoint, but only if needed.
+func (h *Harvester) granularity(ctx context.Context, client Fetcher) (string, error) {
+	if h.Granularity != "" || (h.From.IsZero() && h.Until.IsZero()) {
+		return h.Granularity, nil
+	}
+	ir, err := h.identify(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	log.Debug("using granularity ", ir.Identify.Granularity)
+	return ir.Identify.Granularity, nil
+}
+
+// listLink returns the link to the first page of a list request for a set, or
+// for all records, if set is empty.
+func (h *Harvester) listLink(verb, set, granularity string) string {
+	opts := ListOptions{
+		MetadataPrefix: h.Format,
+		Set:            set,
+		From:           h.From,
+		Until:          h.Until,
+		Granularity:    granularity,
+	}
+	return requestLink(h.base, opts.values(verb))
+}
+
+// tokenLink returns the link to the next page of a list request.
+func (h *Harvester) tokenLink(verb, token string) string {
+	return requestLink(h.base, ListOptions{ResumptionToken: token}.values(verb))
+}
 
-	return nil
+// ParseDatestamp parses a datestamp with day or second granularity.
+func ParseDatestamp(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// formatDatestamp formats a time as UTC datestamp with the given granularity.
+// Anything but second granularity falls back to days, as every repository
+// must support it.
+func formatDatestamp(t time.Time, granularity string) string {
+	if granularity == GranularitySecond {
+		return t.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// endOfDay returns the last second of the day of t, if t is a date without
+// time, i.e. midnight UTC, and granularity is seconds. An until date then
+// includes the whole day, as it does with day granularity.
+func endOfDay(t time.Time, granularity string) time.Time {
+	u := t.UTC()
+	if granularity != GranularitySecond || !u.Equal(u.Truncate(24*time.Hour)) {
+		return t
+	}
+	return u.Add(24*time.Hour - time.Second)
 }
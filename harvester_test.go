@@ -0,0 +1,576 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRepository is a minimal OAI endpoint serving ListIdentifiers and
+// ListRecords in pages and GetRecord for a fixed list of identifiers.
+type testRepository struct {
+	Identifiers []string
+	PageSize    int
+	// Delay is applied before each GetRecord response.
+	Delay time.Duration
+	// Errors maps identifiers to OAI error codes returned by GetRecord.
+	Errors map[string]string
+	// Granularity and DeletedRecord are reported by Identify.
+	Granularity   string
+	DeletedRecord string
+	// SetSpecs maps identifiers to the sets they belong to.
+	SetSpecs map[string][]string
+	// Broken identifiers result in invalid XML in ListRecords responses.
+	Broken map[string]bool
+	// Deleted identifiers are returned as deleted records.
+	Deleted map[string]bool
+	// TokenPrefix is prepended to resumption tokens and required in requests.
+	TokenPrefix string
+	// VerbTokens makes resumption tokens valid for the verb they were
+	// issued for only.
+	VerbTokens bool
+	// RecordsPageSize is the page size of ListRecords, if not zero.
+	RecordsPageSize int
+
+	mu       sync.Mutex
+	requests map[string]int
+	forms    []url.Values
+}
+
+func (repo *testRepository) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo.mu.Lock()
+	if repo.requests == nil {
+		repo.requests = make(map[string]int)
+	}
+	repo.requests[r.FormValue("verb")]++
+	repo.forms = append(repo.forms, r.Form)
+	repo.mu.Unlock()
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+<responseDate>2017-09-11T07:23:49Z</responseDate>`)
+	defer fmt.Fprintf(w, "</OAI-PMH>\n")
+
+	switch verb := r.FormValue("verb"); verb {
+	case "Identify":
+		fmt.Fprintf(w, "<Identify><deletedRecord>%s</deletedRecord><granularity>%s</granularity></Identify>",
+			repo.DeletedRecord, repo.Granularity)
+	case "ListIdentifiers", "ListRecords":
+		// Tokens are offsets, optionally prefixed with the set, and valid
+		// for both verbs, unless VerbTokens is set.
+		prefix := repo.TokenPrefix
+		if repo.VerbTokens {
+			prefix += verb + ":"
+		}
+		set, token := r.FormValue("set"), r.FormValue("resumptionToken")
+		if token != "" && !strings.HasPrefix(token, prefix) {
+			fmt.Fprintf(w, `<error code="badResumptionToken">%s</error>`, html.EscapeString(token))
+			return
+		}
+		token = strings.TrimPrefix(token, prefix)
+		if i := strings.LastIndex(token, "|"); i >= 0 {
+			set, token = token[:i], token[i+1:]
+		}
+		ids := repo.list(set)
+		offset, _ := strconv.Atoi(token)
+		size := repo.PageSize
+		if verb == "ListRecords" && repo.RecordsPageSize > 0 {
+			size = repo.RecordsPageSize
+		}
+		end := offset + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		fmt.Fprintf(w, "<%s>", verb)
+		for _, id := range ids[offset:end] {
+			if verb == "ListIdentifiers" {
+				repo.writeHeader(w, id)
+			} else {
+				repo.writeRecord(w, id, repo.Broken[id])
+			}
+		}
+		if end < len(ids) {
+			next := strconv.Itoa(end)
+			if set != "" {
+				next = set + "|" + next
+			}
+			fmt.Fprintf(w, `<resumptionToken completeListSize="%d" cursor="%d">%s</resumptionToken>`,
+				len(ids), offset, html.EscapeString(prefix+next))
+		}
+		fmt.Fprintf(w, "</%s>", verb)
+	case "ListSets":
+		fmt.Fprintf(w, "<ListSets>")
+		for _, spec := range repo.sets() {
+			fmt.Fprintf(w, "<set><setSpec>%s</setSpec><setName>%s</setName></set>", spec, spec)
+		}
+		fmt.Fprintf(w, "</ListSets>")
+	case "ListMetadataFormats":
+		if id := r.FormValue("identifier"); id != "" && !repo.has(id) {
+			fmt.Fprintf(w, `<error code="idDoesNotExist">unknown</error>`)
+			return
+		}
+		fmt.Fprintf(w, "<ListMetadataFormats><metadataFormat><metadataPrefix>oai_dc</metadataPrefix>"+
+			"</metadataFormat></ListMetadataFormats>")
+	case "GetRecord":
+		time.Sleep(repo.Delay)
+		id := r.FormValue("identifier")
+		if code, ok := repo.Errors[id]; ok {
+			fmt.Fprintf(w, `<error code="%s">failed</error>`, code)
+			return
+		}
+		fmt.Fprintf(w, "<GetRecord>")
+		repo.writeRecord(w, id, false)
+		fmt.Fprintf(w, "</GetRecord>")
+	default:
+		fmt.Fprintf(w, `<error code="badVerb">illegal verb</error>`)
+	}
+}
+
+func (repo *testRepository) writeHeader(w io.Writer, id string) {
+	if repo.Deleted[id] {
+		fmt.Fprintf(w, `<header status="deleted">`)
+	} else {
+		fmt.Fprintf(w, "<header>")
+	}
+	fmt.Fprintf(w, "<identifier>%s</identifier><datestamp>2017-01-01</datestamp>", html.EscapeString(id))
+	for _, spec := range repo.SetSpecs[id] {
+		fmt.Fprintf(w, "<setSpec>%s</setSpec>", spec)
+	}
+	fmt.Fprintf(w, "</header>")
+}
+
+func (repo *testRepository) writeRecord(w io.Writer, id string, broken bool) {
+	fmt.Fprintf(w, "<record>")
+	repo.writeHeader(w, id)
+	if repo.Deleted[id] {
+		fmt.Fprintf(w, "</record>")
+		return
+	}
+	if broken {
+		fmt.Fprintf(w, "<metadata><dc>\x01</dc></metadata></record>")
+		return
+	}
+	fmt.Fprintf(w, "<metadata><dc>%s</dc></metadata></record>", html.EscapeString(id))
+}
+
+// list returns the identifiers in a set, or all identifiers.
+func (repo *testRepository) list(set string) []string {
+	if set == "" {
+		return repo.Identifiers
+	}
+	var ids []string
+	for _, id := range repo.Identifiers {
+		for _, spec := range repo.SetSpecs[id] {
+			if spec == set || strings.HasPrefix(spec, set+":") {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// sets returns the distinct set specs of all identifiers, sorted.
+func (repo *testRepository) sets() []string {
+	seen := make(map[string]bool)
+	var specs []string
+	for _, id := range repo.Identifiers {
+		for _, spec := range repo.SetSpecs[id] {
+			if !seen[spec] {
+				seen[spec] = true
+				specs = append(specs, spec)
+			}
+		}
+	}
+	sort.Strings(specs)
+	return specs
+}
+
+// has reports, whether the repository contains an identifier.
+func (repo *testRepository) has(id string) bool {
+	for _, v := range repo.Identifiers {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests returns the number of requests seen for a verb.
+func (repo *testRepository) Requests(verb string) int {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.requests[verb]
+}
+
+// Forms returns the request parameters of all requests for a verb.
+func (repo *testRepository) Forms(verb string) (result []url.Values) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, form := range repo.forms {
+		if form.Get("verb") == verb {
+			result = append(result, form)
+		}
+	}
+	return result
+}
+
+func testIdentifiers(n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("oai:test:%d", i))
+	}
+	return ids
+}
+
+func TestRun(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.NumWorkers = 4
+	h.Output = &buf
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.Requests("ListIdentifiers"); got != 3 {
+		t.Errorf("got %d ListIdentifiers requests, want 3", got)
+	}
+	if got := strings.Count(buf.String(), "<GetRecord>"); got != 25 {
+		t.Errorf("got %d records, want 25", got)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(1000), PageSize: 10, Delay: 10 * time.Millisecond}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.NumWorkers = 2
+	h.Output = &buf
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	n := strings.Count(buf.String(), "<GetRecord>")
+	if n == 0 || n >= 1000 {
+		t.Errorf("got %d records, want a partial harvest", n)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(100),
+		PageSize:    10,
+		Errors:      map[string]string{"oai:test:5": "cannotDisseminateFormat"},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.NumWorkers = 4
+	h.MaxElapsedTime = 50 * time.Millisecond
+	h.Output = &buf
+	err := h.Run()
+	perr, ok := err.(*ProtocolError)
+	if !ok {
+		t.Fatalf("got %#v, want *ProtocolError", err)
+	}
+	if perr.Err.Code != "cannotDisseminateFormat" {
+		t.Errorf("got code %q, want cannotDisseminateFormat", perr.Err.Code)
+	}
+	if !strings.Contains(perr.URL, url.QueryEscape("oai:test:5")) {
+		t.Errorf("URL %s does not mention identifier", perr.URL)
+	}
+
+	buf.Reset()
+	h.BestEffort = true
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(buf.String(), "<GetRecord>"); got != 99 {
+		t.Errorf("got %d records, want 99", got)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestRunWriteError(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(100), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	h := NewHarvester(ts.URL)
+	h.Output = failingWriter{}
+	if err := h.Run(); err == nil || err.Error() != "disk full" {
+		t.Fatalf("got %v, want disk full", err)
+	}
+}
+
+func TestRunFromUntil(t *testing.T) {
+	var cases = []struct {
+		granularity string
+		from, until string
+	}{
+		{GranularityDay, "2017-01-01", "2017-01-31"},
+		{GranularitySecond, "2017-01-01T10:00:00Z", "2017-01-31T23:59:59Z"},
+		{"", "2017-01-01", "2017-01-31"},
+	}
+	for _, c := range cases {
+		repo := &testRepository{Identifiers: testIdentifiers(5), PageSize: 10, Granularity: c.granularity}
+		ts := httptest.NewServer(repo)
+
+		h := NewHarvester(ts.URL)
+		h.Output = ioutil.Discard
+		h.From = time.Date(2017, 1, 1, 10, 0, 0, 0, time.UTC)
+		h.Until = time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		forms := repo.Forms("ListIdentifiers")
+		if len(forms) != 1 {
+			t.Fatalf("got %d ListIdentifiers requests, want 1", len(forms))
+		}
+		if got := forms[0].Get("from"); got != c.from {
+			t.Errorf("granularity %q: got from=%s, want %s", c.granularity, got, c.from)
+		}
+		if got := forms[0].Get("until"); got != c.until {
+			t.Errorf("granularity %q: got until=%s, want %s", c.granularity, got, c.until)
+		}
+		ts.Close()
+	}
+
+	// An until with time is sent as it is.
+	until := time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC)
+	if got := formatDatestamp(endOfDay(until, GranularitySecond), GranularitySecond); got != "2017-01-31T12:00:00Z" {
+		t.Errorf("got until=%s, want 2017-01-31T12:00:00Z", got)
+	}
+}
+
+func TestRunSets(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(30),
+		PageSize:    4,
+		SetSpecs:    make(map[string][]string),
+	}
+	for i, id := range repo.Identifiers {
+		switch {
+		case i < 10:
+			repo.SetSpecs[id] = []string{"a"}
+		case i < 15:
+			repo.SetSpecs[id] = []string{"a", "b:x"}
+		case i < 20:
+			repo.SetSpecs[id] = []string{"b"}
+		default:
+			repo.SetSpecs[id] = []string{"c"}
+		}
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	for _, filter := range []bool{false, true} {
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.Sets = []string{"a", "b"}
+		h.FilterSets = filter
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(buf.String(), "<GetRecord>"); got != 20 {
+			t.Errorf("filter=%v: got %d records, want 20", filter, got)
+		}
+		if got := repo.Requests("GetRecord"); got != 20 {
+			t.Errorf("filter=%v: got %d GetRecord requests, want 20", filter, got)
+		}
+		for _, form := range repo.Forms("ListIdentifiers") {
+			if filter && form.Get("set") != "" {
+				t.Errorf("filter=%v: unexpected set parameter", filter)
+			}
+		}
+		repo.mu.Lock()
+		repo.requests, repo.forms = nil, nil
+		repo.mu.Unlock()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var cases = []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{"-1", 0},
+		{"86400", maxRetryAfter},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+	for _, c := range cases {
+		if got := retryAfter(c.value); got != c.want {
+			t.Errorf("retryAfter(%q): got %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(3), PageSize: 10}
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.FormValue("identifier")
+		mu.Lock()
+		attempts[id]++
+		n := attempts[id]
+		mu.Unlock()
+		switch {
+		case id == "oai:test:1" && n == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case id == "oai:test:2":
+			http.NotFound(w, r)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.BestEffort = true
+	started := time.Now()
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("Retry-After not honored, harvest took %s", elapsed)
+	}
+	if got := ids(buf.Bytes()); len(got) != 2 {
+		t.Errorf("got %d records, want 2", len(got))
+	}
+	if attempts["oai:test:1"] != 2 {
+		t.Errorf("got %d attempts after 503, want 2", attempts["oai:test:1"])
+	}
+	if attempts["oai:test:2"] != 1 {
+		t.Errorf("got %d attempts after 404, want 1", attempts["oai:test:2"])
+	}
+
+	h.BestEffort = false
+	err := h.Run()
+	serr, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("got %#v, want *StatusError", err)
+	}
+	if serr.StatusCode != http.StatusNotFound || !strings.Contains(serr.URL, url.QueryEscape("oai:test:2")) {
+		t.Errorf("unexpected status error: %v", serr)
+	}
+}
+
+func TestRunEscaping(t *testing.T) {
+	ids := []string{
+		"oai:test:a&b",
+		"oai:test:1+1",
+		"oai:test:x#y",
+		"oai:test:with space",
+		"oai:test:ü/ä?q=1",
+		"oai:test:100%",
+	}
+	for _, s := range []Strategy{StrategyPerRecord, StrategyListRecords} {
+		repo := &testRepository{
+			Identifiers: ids,
+			PageSize:    2,
+			TokenPrefix: "c2V0+/==&x #",
+		}
+		ts := httptest.NewServer(repo)
+
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL + "/oai?key=a+b%26c")
+		h.Output = &buf
+		h.Strategy = s
+		h.NumWorkers = 2
+		if err := h.Run(); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		ts.Close()
+
+		for _, form := range repo.Forms("GetRecord") {
+			if !repo.has(form.Get("identifier")) {
+				t.Errorf("%s: requested unknown identifier %q", s, form.Get("identifier"))
+			}
+		}
+		for _, verb := range []string{"ListIdentifiers", "ListRecords", "GetRecord"} {
+			for _, form := range repo.Forms(verb) {
+				if form.Get("key") != "a b&c" {
+					t.Errorf("%s: %s: base query not kept: %v", s, verb, form)
+				}
+			}
+		}
+		if h.Stats.Written != len(ids) {
+			t.Errorf("%s: got %d records, want %d", s, h.Stats.Written, len(ids))
+		}
+		for _, id := range ids {
+			if !strings.Contains(buf.String(), html.EscapeString(id)) {
+				t.Errorf("%s: record %q missing", s, id)
+			}
+		}
+	}
+}
+
+func TestRequestLink(t *testing.T) {
+	var tests = []struct {
+		base   string
+		params url.Values
+		want   string
+	}{
+		{
+			"http://example.org/oai",
+			url.Values{"verb": {"GetRecord"}, "identifier": {"oai:x:a&b c"}, "metadataPrefix": {"oai_dc"}},
+			"http://example.org/oai?verb=GetRecord&identifier=oai%3Ax%3Aa%26b+c&metadataPrefix=oai_dc",
+		},
+		{
+			"http://example.org/oai?key=1",
+			url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {"a+b/c=="}},
+			"http://example.org/oai?key=1&verb=ListIdentifiers&resumptionToken=a%2Bb%2Fc%3D%3D",
+		},
+		{
+			"http://example.org/oai?verb=Identify&key=1",
+			url.Values{"verb": {"ListSets"}},
+			"http://example.org/oai?key=1&verb=ListSets",
+		},
+	}
+	for _, test := range tests {
+		base, err := url.Parse(test.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requestLink(base, test.params); got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
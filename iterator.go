@@ -0,0 +1,202 @@
+package oaicrawl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Progress is the position of an iterator in a list.
+type Progress struct {
+	// Requests is the number of pages requested.
+	Requests int
+	// Items is the number of values returned so far.
+	Items int
+	// Cursor and Total are the cursor and complete list size reported with
+	// the last resumption token, or -1, if unknown.
+	Cursor int
+	Total  int
+}
+
+// pager follows the resumption tokens of a list request.
+type pager struct {
+	ctx      context.Context
+	token    string
+	started  bool
+	err      error
+	progress Progress
+}
+
+func newPager(ctx context.Context, token string) pager {
+	return pager{ctx: ctx, token: token, progress: Progress{Cursor: -1, Total: -1}}
+}
+
+// next requests the next page with fetch, which returns the resumption token
+// of the page. It reports false at the end of the list or on error. An empty
+// list, reported as protocol error, is not an error.
+func (p *pager) next(fetch func(token string) (*WithResumptionToken, error)) bool {
+	if p.err != nil || (p.started && p.token == "") {
+		return false
+	}
+	rt, err := fetch(p.token)
+	p.started = true
+	if err != nil {
+		if perr, ok := err.(*ProtocolError); ok {
+			switch perr.Err.Code {
+			case "noRecordsMatch", "noSetHierarchy":
+				p.token = ""
+				return false
+			}
+		}
+		p.err = err
+		return false
+	}
+	p.progress.Requests++
+	t := rt.ResumptionToken
+	if t.Value != "" && t.Value == p.token {
+		p.err = fmt.Errorf("endpoint repeated resumption token: %s", t.Value)
+		return false
+	}
+	p.token = t.Value
+	p.progress.Cursor = atoiDefault(t.Cursor, -1)
+	p.progress.Total = atoiDefault(t.CompleteListSize, p.progress.Total)
+	return true
+}
+
+// Err returns the error, that stopped the iteration, if any.
+func (p *pager) Err() error { return p.err }
+
+// Progress returns the position in the list.
+func (p *pager) Progress() Progress { return p.progress }
+
+// Token returns the resumption token of the page after the current one, or
+// an empty string at the end of the list. Once all values of the current page
+// have been consumed, an iterator started with this token continues with the
+// remaining values, so it can be saved to resume a harvest later.
+func (p *pager) Token() string { return p.token }
+
+// atoiDefault parses an integer or returns a default value.
+func atoiDefault(s string, v int) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return v
+}
+
+// HeaderIterator pages through the headers of a ListIdentifiers request.
+type HeaderIterator struct {
+	pager
+	c       *Client
+	opts    ListOptions
+	headers []Header
+	i       int
+}
+
+// Headers returns an iterator over the headers selected by opts, starting at
+// opts.ResumptionToken, if set.
+func (c *Client) Headers(ctx context.Context, opts ListOptions) *HeaderIterator {
+	return &HeaderIterator{pager: newPager(ctx, opts.ResumptionToken), c: c, opts: opts}
+}
+
+// Next advances to the next header, requesting the next page, if needed. It
+// returns false at the end of the list or on error.
+func (it *HeaderIterator) Next() bool {
+	for it.i >= len(it.headers) {
+		ok := it.next(func(token string) (*WithResumptionToken, error) {
+			it.opts.ResumptionToken = token
+			resp, err := it.c.ListIdentifiers(it.ctx, it.opts)
+			if err != nil {
+				return nil, err
+			}
+			it.headers, it.i = resp.ListIdentifiers.Headers, 0
+			return &resp.ListIdentifiers.WithResumptionToken, nil
+		})
+		if !ok {
+			return false
+		}
+	}
+	it.i++
+	it.progress.Items++
+	return true
+}
+
+// Value returns the current header.
+func (it *HeaderIterator) Value() Header { return it.headers[it.i-1] }
+
+// RecordIterator pages through the records of a ListRecords request.
+type RecordIterator struct {
+	pager
+	c       *Client
+	opts    ListOptions
+	records []Record
+	i       int
+}
+
+// Records returns an iterator over the records selected by opts, starting at
+// opts.ResumptionToken, if set.
+func (c *Client) Records(ctx context.Context, opts ListOptions) *RecordIterator {
+	return &RecordIterator{pager: newPager(ctx, opts.ResumptionToken), c: c, opts: opts}
+}
+
+// Next advances to the next record, requesting the next page, if needed. It
+// returns false at the end of the list or on error.
+func (it *RecordIterator) Next() bool {
+	for it.i >= len(it.records) {
+		ok := it.next(func(token string) (*WithResumptionToken, error) {
+			it.opts.ResumptionToken = token
+			resp, err := it.c.ListRecords(it.ctx, it.opts)
+			if err != nil {
+				return nil, err
+			}
+			it.records, it.i = resp.ListRecords.Records, 0
+			return &resp.ListRecords.WithResumptionToken, nil
+		})
+		if !ok {
+			return false
+		}
+	}
+	it.i++
+	it.progress.Items++
+	return true
+}
+
+// Value returns the current record.
+func (it *RecordIterator) Value() Record { return it.records[it.i-1] }
+
+// SetIterator pages through the sets of a repository.
+type SetIterator struct {
+	pager
+	c    *Client
+	sets []Set
+	i    int
+}
+
+// Sets returns an iterator over the sets of the repository, starting at
+// token, if not empty.
+func (c *Client) Sets(ctx context.Context, token string) *SetIterator {
+	return &SetIterator{pager: newPager(ctx, token), c: c}
+}
+
+// Next advances to the next set, requesting the next page, if needed. It
+// returns false at the end of the list or on error.
+func (it *SetIterator) Next() bool {
+	for it.i >= len(it.sets) {
+		ok := it.next(func(token string) (*WithResumptionToken, error) {
+			resp, err := it.c.ListSets(it.ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			it.sets, it.i = resp.ListSets.Sets, 0
+			return &resp.ListSets.WithResumptionToken, nil
+		})
+		if !ok {
+			return false
+		}
+	}
+	it.i++
+	it.progress.Items++
+	return true
+}
+
+// Value returns the current set.
+func (it *SetIterator) Value() Set { return it.sets[it.i-1] }
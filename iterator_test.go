@@ -0,0 +1,154 @@
+package oaicrawl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderIterator(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(10), PageSize: 3}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+	it := c.Headers(context.Background(), ListOptions{MetadataPrefix: "oai_dc"})
+	var ids []string
+	for it.Next() {
+		ids = append(ids, it.Value().Identifier)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 10 || ids[0] != "oai:test:0" || ids[9] != "oai:test:9" {
+		t.Errorf("got identifiers %v", ids)
+	}
+	want := Progress{Requests: 4, Items: 10, Cursor: -1, Total: 10}
+	if p := it.Progress(); p != want {
+		t.Errorf("got progress %+v, want %+v", p, want)
+	}
+	if it.Token() != "" {
+		t.Errorf("got token %q at end of list", it.Token())
+	}
+}
+
+func TestHeaderIteratorResume(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(10), PageSize: 4}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+	it := c.Headers(context.Background(), ListOptions{MetadataPrefix: "oai_dc"})
+	for i := 0; i < 4; i++ {
+		if !it.Next() {
+			t.Fatal(it.Err())
+		}
+	}
+	if p := it.Progress(); p.Cursor != 0 || p.Total != 10 {
+		t.Errorf("got progress %+v", p)
+	}
+	token := it.Token()
+	if token != "4" {
+		t.Fatalf("got token %q, want 4", token)
+	}
+	it = c.Headers(context.Background(), ListOptions{MetadataPrefix: "oai_dc", ResumptionToken: token})
+	var ids []string
+	for it.Next() {
+		if len(ids) == 0 && it.Progress().Cursor != 4 {
+			t.Errorf("got cursor %d, want 4", it.Progress().Cursor)
+		}
+		ids = append(ids, it.Value().Identifier)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 6 || ids[0] != "oai:test:4" {
+		t.Errorf("got identifiers %v", ids)
+	}
+}
+
+func TestRecordIterator(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(6),
+		PageSize:    1,
+		SetSpecs: map[string][]string{
+			"oai:test:1": {"a"},
+			"oai:test:4": {"a:b"},
+		},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+	it := c.Records(context.Background(), ListOptions{MetadataPrefix: "oai_dc", Set: "a"})
+	var ids []string
+	for it.Next() {
+		ids = append(ids, it.Value().Header.Identifier)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[oai:test:1 oai:test:4]" {
+		t.Errorf("got identifiers %v", ids)
+	}
+	if it.Progress().Requests != 2 {
+		t.Errorf("got %d requests, want 2", it.Progress().Requests)
+	}
+}
+
+func TestSetIterator(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(2),
+		SetSpecs: map[string][]string{
+			"oai:test:0": {"b", "a"},
+			"oai:test:1": {"a"},
+		},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+	it := c.Sets(context.Background(), "")
+	var specs []string
+	for it.Next() {
+		specs = append(specs, it.Value().SetSpec)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(specs) != "[a b]" {
+		t.Errorf("got sets %v", specs)
+	}
+}
+
+func TestIteratorErrors(t *testing.T) {
+	var tests = []struct {
+		body    string
+		wantErr bool
+	}{
+		{`<error code="noRecordsMatch">empty</error>`, false},
+		{`<error code="badArgument">bad</error>`, true},
+		{`<ListIdentifiers><header><identifier>a</identifier></header>` +
+			`<resumptionToken>same</resumptionToken></ListIdentifiers>`, true},
+	}
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">%s</OAI-PMH>`, test.body)
+		}))
+		c := &Client{Base: ts.URL, Fetcher: http.DefaultClient}
+		it := c.Headers(context.Background(), ListOptions{MetadataPrefix: "oai_dc"})
+		var n int
+		for it.Next() {
+			n++
+		}
+		if (it.Err() != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.body, it.Err())
+		}
+		if n > 2 {
+			t.Errorf("%s: got %d headers", test.body, n)
+		}
+		ts.Close()
+	}
+}
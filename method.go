@@ -0,0 +1,86 @@
+package oaicrawl
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkMethod returns an error for request methods other than GET and POST.
+// An empty method means GET.
+func checkMethod(method string) error {
+	switch method {
+	case "", http.MethodGet, http.MethodPost:
+		return nil
+	default:
+		return fmt.Errorf("unsupported request method: %s", method)
+	}
+}
+
+// methodFetcher sends requests, which are built as GET requests, with the
+// configured method. With POST, the query is sent as form in the body. GET
+// requests rejected with 414 URI Too Long are sent again as POST.
+type methodFetcher struct {
+	Fetcher
+	post bool
+}
+
+// Do performs the request as GET or POST.
+func (f *methodFetcher) Do(req *http.Request) (*http.Response, error) {
+	if f.post {
+		return f.doPost(req)
+	}
+	resp, err := f.Fetcher.Do(req)
+	if err != nil || resp.StatusCode != http.StatusRequestURITooLong || req.Method != http.MethodGet {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.Debug(req.URL, ": uri too long, retrying with POST")
+	return f.doPost(req)
+}
+
+// oaiArguments are the request arguments defined by the protocol.
+var oaiArguments = map[string]bool{
+	"verb":            true,
+	"identifier":      true,
+	"metadataPrefix":  true,
+	"from":            true,
+	"until":           true,
+	"set":             true,
+	"resumptionToken": true,
+}
+
+// doPost performs a GET request as POST, with the protocol arguments of the
+// query as form encoded body. Other parameters, e.g. of the base URL, stay in
+// the query. Other requests are performed as they are.
+func (f *methodFetcher) doPost(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return f.Fetcher.Do(req)
+	}
+	u := *req.URL
+	var query, form []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, err := url.QueryUnescape(strings.SplitN(param, "=", 2)[0])
+		if err == nil && oaiArguments[key] {
+			form = append(form, param)
+		} else {
+			query = append(query, param)
+		}
+	}
+	u.RawQuery = strings.Join(query, "&")
+	post, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(strings.Join(form, "&")))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		post.Header[k] = v
+	}
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return f.Fetcher.Do(post.WithContext(req.Context()))
+}
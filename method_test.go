@@ -0,0 +1,136 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// methodCounter counts requests by method and rejects GET requests with a
+// resumption token as too long, if tooLong is set. POST requests must keep
+// the query of the base URL and send only the protocol arguments as form.
+type methodCounter struct {
+	http.Handler
+	tooLong   bool
+	baseQuery string
+
+	mu      sync.Mutex
+	methods map[string]int
+}
+
+func (m *methodCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	if m.methods == nil {
+		m.methods = make(map[string]int)
+	}
+	m.methods[r.Method]++
+	m.mu.Unlock()
+	if r.Method == http.MethodPost {
+		if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+			http.Error(w, "form expected", http.StatusBadRequest)
+			return
+		}
+		r.ParseForm()
+		for k := range r.PostForm {
+			if !oaiArguments[k] {
+				http.Error(w, "unexpected form parameter: "+k, http.StatusBadRequest)
+				return
+			}
+		}
+		if r.URL.RawQuery != m.baseQuery {
+			http.Error(w, "base query not kept: "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+	}
+	if m.tooLong && r.Method == http.MethodGet && r.URL.Query().Get("resumptionToken") != "" {
+		http.Error(w, "uri too long", http.StatusRequestURITooLong)
+		return
+	}
+	m.Handler.ServeHTTP(w, r)
+}
+
+func (m *methodCounter) count(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.methods[method]
+}
+
+func TestRunPost(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(10), PageSize: 3, TokenPrefix: "a+b/"}
+	counter := &methodCounter{Handler: repo, baseQuery: "api+key=a%2Fb&key=1"}
+	ts := httptest.NewServer(counter)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL + "?key=1&api+key=a%2Fb")
+	h.Output = &buf
+	h.Method = http.MethodPost
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Stats.Written != 10 {
+		t.Errorf("got %d records, want 10", h.Stats.Written)
+	}
+	if n := counter.count(http.MethodGet); n != 0 {
+		t.Errorf("got %d GET requests, want 0", n)
+	}
+	if n := counter.count(http.MethodPost); n != 14 {
+		t.Errorf("got %d POST requests, want 14", n)
+	}
+	for _, form := range repo.Forms("GetRecord") {
+		if form.Get("key") != "1" {
+			t.Errorf("base query not kept: %v", form)
+		}
+	}
+}
+
+func TestRunPostFallback(t *testing.T) {
+	for _, s := range []Strategy{StrategyPerRecord, StrategyListRecords} {
+		repo := &testRepository{Identifiers: testIdentifiers(10), PageSize: 3}
+		counter := &methodCounter{Handler: repo, tooLong: true, baseQuery: "key=1"}
+		ts := httptest.NewServer(counter)
+
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL + "?key=1")
+		h.Output = &buf
+		h.Strategy = s
+		if err := h.Run(); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		ts.Close()
+		if h.Stats.Written != 10 {
+			t.Errorf("%s: got %d records, want 10", s, h.Stats.Written)
+		}
+		// Each of the three pages requested with a token is retried as POST.
+		if n := counter.count(http.MethodPost); n != 3 {
+			t.Errorf("%s: got %d POST requests, want 3", s, n)
+		}
+	}
+}
+
+func TestClientPost(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(1), Granularity: GranularityDay}
+	counter := &methodCounter{Handler: repo}
+	ts := httptest.NewServer(counter)
+	defer ts.Close()
+
+	c := &Client{Base: ts.URL, Fetcher: http.DefaultClient, Method: http.MethodPost}
+	ir, err := c.Identify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Identify.Granularity != GranularityDay {
+		t.Errorf("got granularity %q", ir.Identify.Granularity)
+	}
+	if counter.count(http.MethodPost) != 1 || counter.count(http.MethodGet) != 0 {
+		t.Errorf("got methods %v", counter.methods)
+	}
+
+	c.Method = "PUT"
+	if _, err := c.Identify(context.Background()); err == nil {
+		t.Error("expected error for unsupported method")
+	}
+}
@@ -0,0 +1,274 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// OutputFormat determines how records are written to Output.
+type OutputFormat int
+
+const (
+	// OutputRaw writes each record as GetRecord response, as received.
+	OutputRaw OutputFormat = iota
+	// OutputJSON writes one JSON object per line and record, see JSONRecord.
+	OutputJSON
+	// OutputXML writes a single XML document, shaped like a ListRecords
+	// response, containing all records.
+	OutputXML
+	// OutputWARC writes every HTTP request and response of the harvest as
+	// gzip compressed WARC records instead of the records themselves.
+	OutputWARC
+)
+
+var outputFormatNames = map[OutputFormat]string{
+	OutputRaw:  "raw",
+	OutputJSON: "jsonl",
+	OutputXML:  "xml",
+	OutputWARC: "warc",
+}
+
+// String returns the name of the output format.
+func (f OutputFormat) String() string {
+	if name, ok := outputFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("OutputFormat(%d)", int(f))
+}
+
+// ParseOutputFormat returns the output format for a name, as returned by
+// String.
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	for f, n := range outputFormatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown output format: %s", name)
+}
+
+// JSONRecord is the JSON representation of a record. Metadata and About
+// contain the XML of the respective elements verbatim.
+type JSONRecord struct {
+	Identifier     string   `json:"identifier"`
+	Datestamp      string   `json:"datestamp,omitempty"`
+	SetSpecs       []string `json:"setSpecs,omitempty"`
+	Status         string   `json:"status,omitempty"`
+	MetadataPrefix string   `json:"metadataPrefix,omitempty"`
+	Metadata       string   `json:"metadata,omitempty"`
+	About          string   `json:"about,omitempty"`
+}
+
+// NewJSONRecord converts a GetRecord response into a JSONRecord.
+func NewJSONRecord(resp GetRecordResponse) JSONRecord {
+	rec := resp.GetRecord.Record
+	return JSONRecord{
+		Identifier:     rec.Header.Identifier,
+		Datestamp:      rec.Header.DateStamp,
+		SetSpecs:       rec.Header.SetSpec,
+		Status:         rec.Header.Status,
+		MetadataPrefix: resp.Request.MetadataPrefix,
+		Metadata:       string(rec.Metadata.Body),
+		About:          string(rec.About.Body),
+	}
+}
+
+// encode converts a GetRecord response into the output format.
+func (h *Harvester) encode(r result) ([]byte, error) {
+	switch h.OutputFormat {
+	case OutputJSON:
+		var resp GetRecordResponse
+		dec := xml.NewDecoder(bytes.NewReader(r.Body))
+		dec.Strict = false
+		if err := dec.Decode(&resp); err != nil {
+			return nil, &DecodeError{URL: r.URL, Err: err}
+		}
+		jr := NewJSONRecord(resp)
+		if jr.MetadataPrefix == "" {
+			jr.MetadataPrefix = h.Format
+		}
+		b, err := json.Marshal(jr)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case OutputXML:
+		b, err := extractRecord(r.Body)
+		if err != nil {
+			return nil, &DecodeError{URL: r.URL, Err: err}
+		}
+		return append(b, '\n'), nil
+	case OutputWARC:
+		// Records are written as part of the recorded exchanges.
+		return nil, nil
+	default:
+		return r.Body, nil
+	}
+}
+
+// frame returns the data to write before the first and after the last record.
+func (h *Harvester) frame(started time.Time) (header, footer []byte, err error) {
+	switch h.OutputFormat {
+	case OutputWARC:
+		header, err = h.warcInfo(started)
+		return header, nil, err
+	case OutputXML:
+		var buf bytes.Buffer
+		buf.WriteString(xml.Header)
+		buf.WriteString(`<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/" ` +
+			`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` + "\n")
+		fmt.Fprintf(&buf, "<responseDate>%s</responseDate>\n", started.UTC().Format("2006-01-02T15:04:05Z"))
+		buf.WriteString(`<request verb="ListRecords" metadataPrefix="`)
+		xml.EscapeText(&buf, []byte(h.Format))
+		buf.WriteString(`">`)
+		xml.EscapeText(&buf, []byte(h.Base))
+		buf.WriteString("</request>\n<ListRecords>\n")
+		return buf.Bytes(), []byte("</ListRecords>\n</OAI-PMH>\n"), nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// begin writes anything required before the first record to Output and
+// returns what to write after the last record. Outputs, which split the
+// harvest into several files, frame each file themselves.
+func (h *Harvester) begin(started time.Time) (footer []byte, err error) {
+	header, footer, err := h.frame(started)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := h.Output.(framer); ok {
+		f.SetFrame(func() ([]byte, error) {
+			header, _, err := h.frame(started)
+			return header, err
+		}, footer)
+		return nil, nil
+	}
+	if len(header) > 0 {
+		if _, err := h.Output.Write(header); err != nil {
+			return nil, err
+		}
+	}
+	return footer, nil
+}
+
+// extractRecord returns the record element of a GetRecord response verbatim,
+// with the namespace declarations of the enclosing elements added to its start
+// tag, so it can be embedded into another document.
+func extractRecord(b []byte) ([]byte, error) {
+	records, err := extractRecords(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no record element found")
+	}
+	return records[0], nil
+}
+
+// extractRecords returns the record elements of a response verbatim, like
+// extractRecord, e.g. all records of a ListRecords page.
+func extractRecords(b []byte) ([][]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	var (
+		records [][]byte
+		// decls are the namespace declarations of the enclosing elements,
+		// scopes the number of declarations outside each of them.
+		decls  []xml.Attr
+		scopes []int
+	)
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.EndElement:
+			if n := len(scopes); n > 0 {
+				decls, scopes = decls[:scopes[n-1]], scopes[:n-1]
+			}
+		case xml.StartElement:
+			if t.Name.Local != "record" {
+				scopes = append(scopes, len(decls))
+				for _, attr := range t.Attr {
+					if isNamespaceDecl(attr) {
+						decls = append(decls, attr)
+					}
+				}
+				continue
+			}
+			// The record starts at offset, find its end.
+			for depth := 1; depth > 0; {
+				tok, err := dec.RawToken()
+				if err != nil {
+					return nil, err
+				}
+				switch tok.(type) {
+				case xml.StartElement:
+					depth++
+				case xml.EndElement:
+					depth--
+				}
+			}
+			records = append(records, withDecls(b[offset:dec.InputOffset()], t, decls))
+		}
+	}
+}
+
+// isNamespaceDecl reports, whether an attribute declares a namespace.
+func isNamespaceDecl(attr xml.Attr) bool {
+	return attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")
+}
+
+// withDecls adds namespace declarations to the start tag of an element, which
+// are not declared on the element itself. Inner declarations override outer
+// ones.
+func withDecls(elem []byte, se xml.StartElement, decls []xml.Attr) []byte {
+	declared := make(map[string]string)
+	var order []string
+	for _, attr := range decls {
+		key := attr.Name.Space + ":" + attr.Name.Local
+		if _, ok := declared[key]; !ok {
+			order = append(order, key)
+		}
+		declared[key] = attr.Value
+	}
+	for _, attr := range se.Attr {
+		if isNamespaceDecl(attr) {
+			delete(declared, attr.Name.Space+":"+attr.Name.Local)
+		}
+	}
+	var buf bytes.Buffer
+	name := se.Name.Local
+	if se.Name.Space != "" {
+		name = se.Name.Space + ":" + name
+	}
+	// Elements start with "<" and the name as written.
+	buf.Write(elem[:1+len(name)])
+	for _, key := range order {
+		value, ok := declared[key]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(key, "xmlns:") {
+			buf.WriteString(" " + key + `="`)
+		} else {
+			buf.WriteString(` xmlns="`)
+		}
+		xml.EscapeText(&buf, []byte(value))
+		buf.WriteString(`"`)
+	}
+	buf.Write(elem[1+len(name):])
+	return buf.Bytes()
+}
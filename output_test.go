@@ -0,0 +1,131 @@
+package oaicrawl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewJSONRecord(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/GetRecord-00.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHarvester("http://www.zvdd.de/oai2/")
+	h.OutputFormat = OutputJSON
+	out, err := h.encode(result{Body: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out, []byte("}\n")) || bytes.Count(out, []byte("\n")) != 1 {
+		t.Errorf("expected a single line of JSON")
+	}
+	var rec JSONRecord
+	if err := json.Unmarshal(out, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Identifier != "oai:www.zvdd.de:urn:nbn:de:bsz:25-digilib-147190" {
+		t.Errorf("wrong identifier: %s", rec.Identifier)
+	}
+	if rec.Datestamp != "2017-09-10T02:19:02Z" {
+		t.Errorf("wrong datestamp: %s", rec.Datestamp)
+	}
+	if len(rec.SetSpecs) != 1 || rec.SetSpecs[0] != "druckschriften.dl.ub.uni.freiburg.de" {
+		t.Errorf("wrong set specs: %v", rec.SetSpecs)
+	}
+	if rec.MetadataPrefix != "mets" {
+		t.Errorf("wrong metadata prefix: %s", rec.MetadataPrefix)
+	}
+	if len(rec.Metadata) != 11191 {
+		t.Errorf("wrong metadata length: %d, want 11191", len(rec.Metadata))
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	for _, strategy := range []Strategy{StrategyPerRecord, StrategyListRecords} {
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.OutputFormat = OutputJSON
+		h.Strategy = strategy
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		scanner := bufio.NewScanner(&buf)
+		for scanner.Scan() {
+			var rec JSONRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(rec.Metadata, rec.Identifier) || rec.MetadataPrefix != "oai_dc" {
+				t.Errorf("%v: unexpected record: %#v", strategy, rec)
+			}
+			n++
+		}
+		if n != 25 {
+			t.Errorf("%v: got %d records, want 25", strategy, n)
+		}
+	}
+}
+
+func TestExtractRecord(t *testing.T) {
+	body := `<?xml version="1.0"?>` +
+		`<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+		`<GetRecord><record><header><identifier>a</identifier></header>` +
+		`<metadata><dc:title>T</dc:title></metadata></record></GetRecord></OAI-PMH>`
+	b, err := extractRecord([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<record xmlns="http://www.openarchives.org/OAI/2.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">` +
+		`<header><identifier>a</identifier></header><metadata><dc:title>T</dc:title></metadata></record>`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+	if _, err := extractRecord([]byte("<OAI-PMH/>")); err == nil {
+		t.Errorf("expected error for response without record")
+	}
+}
+
+func TestRunXML(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	for _, strategy := range []Strategy{StrategyPerRecord, StrategyListRecords} {
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.OutputFormat = OutputXML
+		h.Strategy = strategy
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		// The output is a single document, readable as ListRecords response.
+		var resp ListRecordsResponse
+		if err := xml.Unmarshal(buf.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(resp.ListRecords.Records); got != 25 {
+			t.Errorf("%v: got %d records, want 25", strategy, got)
+		}
+		for _, rec := range resp.ListRecords.Records {
+			if !strings.HasPrefix(rec.Header.Identifier, "oai:test:") {
+				t.Errorf("unexpected identifier: %s", rec.Header.Identifier)
+			}
+		}
+		if resp.Request.Verb != "ListRecords" || resp.Request.MetadataPrefix != "oai_dc" {
+			t.Errorf("unexpected request node: %#v", resp.Request)
+		}
+	}
+}
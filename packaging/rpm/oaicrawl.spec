@@ -22,6 +22,7 @@ No frills incremental OAI harvesting for the command line.
 %install
 mkdir -p $RPM_BUILD_ROOT/usr/local/sbin
 install -m 755 oaicrawl $RPM_BUILD_ROOT/usr/local/sbin
+install -m 755 oaiquery $RPM_BUILD_ROOT/usr/local/sbin
 
 %post
 
@@ -34,6 +35,7 @@ rm -rf %{_topdir}/BUILD/%{name}
 %defattr(-,root,root)
 
 /usr/local/sbin/oaicrawl
+/usr/local/sbin/oaiquery
 
 %changelog
 * Tue Sep 12 2017 Martin Czygan
@@ -0,0 +1,92 @@
+package oaicrawl
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limiter spaces requests to a rate with bursts and a minimum delay between
+// the start of two requests. It is shared by all requests of a harvest.
+type limiter struct {
+	interval time.Duration
+	burst    int
+	minDelay time.Duration
+
+	mu sync.Mutex
+	// tat is the theoretical arrival time of the next request at the
+	// configured rate.
+	tat  time.Time
+	last time.Time
+}
+
+// newLimiter returns a limiter for a rate in requests per second, where zero
+// means no limit.
+func newLimiter(rps float64, burst int, minDelay time.Duration) *limiter {
+	l := &limiter{burst: burst, minDelay: minDelay}
+	if rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / rps)
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
+
+// reserve returns the time, at which a request arriving at now may start.
+func (l *limiter) reserve(now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := now
+	if l.interval > 0 {
+		tolerance := time.Duration(l.burst-1) * l.interval
+		if t := l.tat.Add(-tolerance); t.After(start) {
+			start = t
+		}
+	}
+	if l.minDelay > 0 && !l.last.IsZero() {
+		if t := l.last.Add(l.minDelay); t.After(start) {
+			start = t
+		}
+	}
+	if l.interval > 0 {
+		tat := l.tat
+		if start.After(tat) {
+			tat = start
+		}
+		l.tat = tat.Add(l.interval)
+	}
+	l.last = start
+	return start
+}
+
+// wait blocks until a request may start or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	d := time.Until(l.reserve(time.Now()))
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedFetcher waits for the limiter before each request.
+type limitedFetcher struct {
+	Fetcher
+	limiter *limiter
+}
+
+// Do performs the request, once the limiter allows it.
+func (f *limitedFetcher) Do(req *http.Request) (*http.Response, error) {
+	if err := f.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return f.Fetcher.Do(req)
+}
@@ -0,0 +1,89 @@
+package oaicrawl
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		rps      float64
+		burst    int
+		minDelay time.Duration
+		// starts are the offsets, at which ten requests arriving at once
+		// may start.
+		starts []time.Duration
+	}{
+		{10, 1, 0, []time.Duration{0, 100, 200, 300, 400, 500, 600, 700, 800, 900}},
+		{10, 3, 0, []time.Duration{0, 0, 0, 100, 200, 300, 400, 500, 600, 700}},
+		{0, 0, 50 * time.Millisecond, []time.Duration{0, 50, 100, 150, 200, 250, 300, 350, 400, 450}},
+		{10, 3, 50 * time.Millisecond, []time.Duration{0, 50, 100, 150, 200, 300, 400, 500, 600, 700}},
+	}
+	for _, c := range cases {
+		l := newLimiter(c.rps, c.burst, c.minDelay)
+		for i, want := range c.starts {
+			want *= time.Millisecond
+			if got := l.reserve(now).Sub(now); got != want {
+				t.Errorf("rps=%v burst=%d delay=%v: request %d starts at %v, want %v",
+					c.rps, c.burst, c.minDelay, i, got, want)
+			}
+		}
+	}
+}
+
+func TestRunRateLimit(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(9), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	// One ListIdentifiers and nine GetRecord requests, shared by all workers.
+	h := NewHarvester(ts.URL)
+	h.Output = ioutil.Discard
+	h.RateLimit = 50
+	h.Burst = 2
+	started := time.Now()
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 160*time.Millisecond {
+		t.Errorf("harvest took %v, want at least 160ms", elapsed)
+	}
+}
+
+func TestRunRateLimitAttempts(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(6), PageSize: 2}
+	counter := &methodCounter{Handler: repo, tooLong: true}
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		counter.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// Pages requested with a token are sent again as POST, which waits for
+	// the delay as well.
+	h := NewHarvester(ts.URL)
+	h.Output = ioutil.Discard
+	h.MinDelay = 30 * time.Millisecond
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.count(http.MethodPost); n != 2 {
+		t.Errorf("got %d POST requests, want 2", n)
+	}
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < 25*time.Millisecond {
+			t.Errorf("request %d started %v after the previous one, want at least 30ms", i, d)
+		}
+	}
+}
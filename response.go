@@ -13,6 +13,9 @@ type GenericResponse struct {
 	Error        OAIError    `xml:"error,omitempty" json:"error,omitempty"`
 }
 
+// oaiError returns the protocol error of a response, if any.
+func (r GenericResponse) oaiError() OAIError { return r.Error }
+
 // WithResumptionToken can be added to other structs, which can be harvested in batches.
 type WithResumptionToken struct {
 	ResumptionToken struct {
@@ -66,7 +66,7 @@ func TestListIdentifiersWithToken(t *testing.T) {
 	if len(resp.ListIdentifiers.Headers) != 20 {
 		t.Errorf("wrong number of headers: want %v", len(resp.ListIdentifiers.Headers))
 	}
-	if resp.ListIdentifiers.ResumptionToken != "-_--_-oai_dc-_--_-20" {
+	if resp.ListIdentifiers.ResumptionToken.Value != "-_--_-oai_dc-_--_-20" {
 		t.Errorf("wrong token: %s", resp.ListIdentifiers.ResumptionToken)
 	}
 }
@@ -0,0 +1,326 @@
+package oaicrawl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nonFilenameChars are replaced in file names derived from endpoints.
+var nonFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Endpoint is an endpoint to harvest with a Runner, with options overriding
+// those of the runner, if set.
+type Endpoint struct {
+	Base string
+	// Name is used for the output file, if empty, it is derived from Base.
+	Name   string
+	Format string
+	Sets   []string
+	From   time.Time
+	Until  time.Time
+}
+
+// ParseEndpoints reads endpoints, one per line, as a base URL followed by
+// options as key=value, separated by whitespace. Options are name, format,
+// set, which can be repeated, from and until. Empty lines and lines starting
+// with # are ignored.
+//
+//	http://www.acm.org/dl/oai format=oai_dc set=cs from=2017-01-01
+func ParseEndpoints(r io.Reader) ([]Endpoint, error) {
+	var (
+		endpoints []Endpoint
+		scanner   = bufio.NewScanner(r)
+		lineno    int
+	)
+	for scanner.Scan() {
+		lineno++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		e := Endpoint{Base: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %d: option without value: %s", lineno, field)
+			}
+			var err error
+			switch kv[0] {
+			case "name":
+				e.Name = kv[1]
+			case "format":
+				e.Format = kv[1]
+			case "set":
+				e.Sets = append(e.Sets, kv[1])
+			case "from":
+				e.From, err = ParseDatestamp(kv[1])
+			case "until":
+				e.Until, err = ParseDatestamp(kv[1])
+			default:
+				err = fmt.Errorf("unknown option: %s", kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineno, err)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, scanner.Err()
+}
+
+// EndpointResult is the outcome of the harvest of an endpoint.
+type EndpointResult struct {
+	Endpoint Endpoint
+	// Manifest is the path of the manifest listing the files of the endpoint.
+	Manifest string
+	Shards   []Shard
+	Stats    Stats
+	Elapsed  time.Duration
+	Err      error
+}
+
+// Runner harvests several endpoints concurrently, at most MaxEndpoints at a
+// time, each into its own files in Dir, written by a ShardWriter with the name
+// of the endpoint as prefix. All requests share a budget of MaxWorkers
+// concurrent requests, and at most PerHost requests go to the same host at a
+// time.
+type Runner struct {
+	Endpoints    []Endpoint
+	Dir          string
+	MaxEndpoints int
+	MaxWorkers   int
+	PerHost      int
+	// MaxRecords, MaxBytes and Compression apply to the files of each
+	// endpoint, like the fields of a ShardWriter.
+	MaxRecords  int
+	MaxBytes    int64
+	Compression Compression
+	// Configure, if set, sets options of the harvester for each endpoint,
+	// before the options of the endpoint are applied. It must not share
+	// state between harvesters, like a Checkpoint.
+	Configure func(h *Harvester)
+
+	global chan struct{}
+	mu     sync.Mutex
+	hosts  map[string]chan struct{}
+}
+
+// NewRunner creates a runner for endpoints with default limits, writing gzip
+// compressed files of up to 100000 records.
+func NewRunner(endpoints []Endpoint, dir string) *Runner {
+	return &Runner{
+		Endpoints:    endpoints,
+		Dir:          dir,
+		MaxEndpoints: 8,
+		MaxWorkers:   32,
+		PerHost:      4,
+		MaxRecords:   100000,
+		Compression:  CompressGzip,
+	}
+}
+
+// Run harvests all endpoints and returns their results in the order of
+// Endpoints. A failing endpoint does not stop the others. Without positive
+// MaxWorkers and PerHost, all endpoints fail.
+func (r *Runner) Run(ctx context.Context) []EndpointResult {
+	if r.MaxWorkers <= 0 || r.PerHost <= 0 {
+		err := fmt.Errorf("runner: MaxWorkers and PerHost must be positive, got %d and %d",
+			r.MaxWorkers, r.PerHost)
+		results := make([]EndpointResult, len(r.Endpoints))
+		for i, e := range r.Endpoints {
+			results[i] = EndpointResult{Endpoint: e, Err: err}
+		}
+		log.Error(err)
+		return results
+	}
+	r.global = make(chan struct{}, r.MaxWorkers)
+	r.hosts = make(map[string]chan struct{})
+
+	results := make([]EndpointResult, len(r.Endpoints))
+	names := make(map[string]int)
+	// Harvesters of waiting endpoints are not started, so their workers and
+	// open files do not pile up.
+	n := r.MaxEndpoints
+	if n <= 0 {
+		n = len(r.Endpoints)
+	}
+	running := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, e := range r.Endpoints {
+		name := e.Name
+		if name == "" {
+			name = endpointName(e.Base)
+		}
+		if names[name]++; names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		select {
+		case running <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = EndpointResult{Endpoint: e, Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, e Endpoint, name string) {
+			defer wg.Done()
+			defer func() { <-running }()
+			results[i] = r.harvest(ctx, e, name)
+		}(i, e, name)
+	}
+	wg.Wait()
+
+	var failed, written int
+	for _, res := range results {
+		written += res.Stats.Written
+		if res.Err != nil {
+			failed++
+		}
+	}
+	log.Info(fmt.Sprintf("harvested %d endpoints, %d failed, %d records written",
+		len(results), failed, written))
+	return results
+}
+
+// harvest harvests a single endpoint into its files.
+func (r *Runner) harvest(ctx context.Context, e Endpoint, name string) EndpointResult {
+	started := time.Now()
+	h := NewHarvester(e.Base)
+	if r.Configure != nil {
+		r.Configure(h)
+	}
+	if e.Format != "" {
+		h.Format = e.Format
+	}
+	if len(e.Sets) > 0 {
+		h.Sets = e.Sets
+	}
+	if !e.From.IsZero() {
+		h.From = e.From
+	}
+	if !e.Until.IsZero() {
+		h.Until = e.Until
+	}
+	h.NumWorkers = r.PerHost
+	if h.NumWorkers > r.MaxWorkers {
+		h.NumWorkers = r.MaxWorkers
+	}
+	client := h.Fetcher
+	if client == nil {
+		client = NewRetryFetcher(&http.Client{Timeout: 60 * time.Second}, h.MaxRetries)
+	}
+	host, err := r.host(e.Base)
+	if err != nil {
+		return EndpointResult{Endpoint: e, Err: err}
+	}
+	h.Fetcher = inside(client, func(client Fetcher) Fetcher {
+		return &gatedFetcher{Fetcher: client, global: r.global, host: host}
+	})
+
+	sw := &ShardWriter{
+		Dir:         r.Dir,
+		Prefix:      name,
+		Extension:   h.OutputFormat.Extension(),
+		MaxRecords:  r.MaxRecords,
+		MaxBytes:    r.MaxBytes,
+		Compression: r.Compression,
+	}
+	h.Output = sw
+	result := EndpointResult{Endpoint: e, Manifest: sw.manifestName()}
+	result.Err = h.RunContext(ctx)
+	if err := sw.Close(); err != nil && result.Err == nil {
+		result.Err = err
+	}
+	result.Shards = sw.Shards()
+	result.Stats = h.Stats
+	result.Elapsed = time.Since(started)
+	entry := log.WithField("endpoint", e.Base)
+	if result.Err != nil {
+		entry.Warn(result.Err)
+	} else {
+		entry.Info(fmt.Sprintf("%d records written to %s in %s", result.Stats.Written, result.Manifest,
+			result.Elapsed.Round(time.Millisecond)))
+	}
+	return result
+}
+
+// host returns the semaphore of the host of a base URL.
+func (r *Runner) host(base string) (chan struct{}, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sem, ok := r.hosts[u.Hostname()]
+	if !ok {
+		sem = make(chan struct{}, r.PerHost)
+		r.hosts[u.Hostname()] = sem
+	}
+	return sem, nil
+}
+
+// endpointName derives a file name from a base URL.
+func endpointName(base string) string {
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		base = u.Host + u.Path
+	}
+	return strings.Trim(nonFilenameChars.ReplaceAllString(base, "-"), "-.")
+}
+
+// gatedFetcher limits concurrent requests per host and overall.
+type gatedFetcher struct {
+	Fetcher
+	global, host chan struct{}
+}
+
+// Do performs the request, once both the host and the overall limit allow
+// it. The host is acquired first, so requests waiting for a busy host do not
+// block others. Both are released, once the response body is closed.
+func (f *gatedFetcher) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	select {
+	case f.host <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case f.global <- struct{}{}:
+	case <-ctx.Done():
+		<-f.host
+		return nil, ctx.Err()
+	}
+	release := func() {
+		<-f.global
+		<-f.host
+	}
+	resp, err := f.Fetcher.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody calls release, when closed for the first time.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
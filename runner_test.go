@@ -0,0 +1,229 @@
+package oaicrawl
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseEndpoints(t *testing.T) {
+	endpoints, err := ParseEndpoints(strings.NewReader(`# endpoints
+http://example.com/oai
+
+http://example.org/oai2 format=mets set=a set=b:c from=2017-01-01 name=org
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 2 {
+		t.Fatalf("got %d endpoints, want 2", len(endpoints))
+	}
+	e := endpoints[1]
+	if e.Base != "http://example.org/oai2" || e.Format != "mets" || e.Name != "org" ||
+		len(e.Sets) != 2 || e.Sets[1] != "b:c" || e.From.Format("2006-01-02") != "2017-01-01" {
+		t.Errorf("unexpected endpoint: %+v", e)
+	}
+	for _, line := range []string{"http://x format", "http://x color=red", "http://x from=yesterday"} {
+		if _, err := ParseEndpoints(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+// peakHandler tracks the peak number of concurrent requests to handlers
+// sharing it.
+type peakHandler struct {
+	mu           sync.Mutex
+	active, peak int
+}
+
+func (p *peakHandler) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.active++
+		if p.active > p.peak {
+			p.peak = p.active
+		}
+		p.mu.Unlock()
+		defer func() {
+			p.mu.Lock()
+			p.active--
+			p.mu.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestRunner(t *testing.T) {
+	var peak peakHandler
+	a := httptest.NewServer(peak.wrap(&testRepository{Identifiers: testIdentifiers(20), PageSize: 10,
+		Delay: 5 * time.Millisecond}))
+	defer a.Close()
+	b := httptest.NewServer(peak.wrap(&testRepository{Identifiers: testIdentifiers(15), PageSize: 10,
+		Delay: 5 * time.Millisecond}))
+	defer b.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer broken.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-runner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRunner([]Endpoint{
+		{Base: a.URL, Name: "a"},
+		{Base: b.URL, Name: "a"},
+		{Base: broken.URL},
+	}, dir)
+	r.PerHost = 3
+	r.MaxRecords = 10
+	r.Configure = func(h *Harvester) {
+		h.MaxElapsedTime = 50 * time.Millisecond
+	}
+	results := r.Run(context.Background())
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []int{20, 15} {
+		res := results[i]
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.Stats.Written != want {
+			t.Errorf("%s: got %d records, want %d", res.Endpoint.Base, res.Stats.Written, want)
+		}
+		if len(res.Shards) != 2 {
+			t.Errorf("%s: got %d files, want 2", res.Manifest, len(res.Shards))
+		}
+		var got int
+		for _, shard := range res.Shards {
+			f, err := os.Open(filepath.Join(dir, shard.File))
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(zr)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got += len(ids(b))
+		}
+		if got != want {
+			t.Errorf("%s: got %d records in files, want %d", res.Manifest, got, want)
+		}
+	}
+	if filepath.Base(results[1].Manifest) != "a-2-manifest.json" || results[1].Shards[0].File != "a-2-00001.xml.gz" {
+		t.Errorf("got manifest %s, files %v", results[1].Manifest, results[1].Shards)
+	}
+	if results[2].Err == nil {
+		t.Errorf("expected error for broken endpoint")
+	}
+	// Both test servers run on the same host.
+	if peak.peak > 3 {
+		t.Errorf("got %d concurrent requests to one host, want at most 3", peak.peak)
+	}
+}
+
+func TestRunnerMaxEndpoints(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		active = make(map[string]int)
+		peak   int
+	)
+	track := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			active[r.Host]++
+			if len(active) > peak {
+				peak = len(active)
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				if active[r.Host]--; active[r.Host] == 0 {
+					delete(active, r.Host)
+				}
+				mu.Unlock()
+			}()
+			h.ServeHTTP(w, r)
+		})
+	}
+	var endpoints []Endpoint
+	for i := 0; i < 3; i++ {
+		ts := httptest.NewServer(track(&testRepository{Identifiers: testIdentifiers(5), PageSize: 10,
+			Delay: 5 * time.Millisecond}))
+		defer ts.Close()
+		endpoints = append(endpoints, Endpoint{Base: ts.URL})
+	}
+
+	dir, err := ioutil.TempDir("", "oaicrawl-runner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRunner(endpoints, dir)
+	r.MaxEndpoints = 1
+	for _, res := range r.Run(context.Background()) {
+		if res.Err != nil || res.Stats.Written != 5 {
+			t.Errorf("%s: got %d records, %v", res.Endpoint.Base, res.Stats.Written, res.Err)
+		}
+	}
+	if peak != 1 {
+		t.Errorf("got %d endpoints harvested at once, want 1", peak)
+	}
+}
+
+func TestRunnerMissing(t *testing.T) {
+	repo := &testRepository{
+		Identifiers:   testIdentifiers(5),
+		PageSize:      10,
+		Errors:        map[string]string{"oai:test:3": "idDoesNotExist"},
+		DeletedRecord: "transient",
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-runner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The Identify request for the missing record needs the only connection
+	// to the host.
+	r := NewRunner([]Endpoint{{Base: ts.URL}}, dir)
+	r.PerHost = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := r.Run(ctx)[0]
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if res.Stats.Deleted != 1 || res.Stats.Written != 5 {
+		t.Errorf("got %d records, %d deleted, want 5 and 1", res.Stats.Written, res.Stats.Deleted)
+	}
+
+	for _, limits := range [][2]int{{0, 1}, {1, 0}} {
+		r.MaxWorkers, r.PerHost = limits[0], limits[1]
+		if res := r.Run(ctx); res[0].Err == nil {
+			t.Errorf("MaxWorkers %d, PerHost %d: expected error", limits[0], limits[1])
+		}
+	}
+}
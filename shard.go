@@ -0,0 +1,396 @@
+package oaicrawl
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Compression of output files.
+type Compression int
+
+const (
+	// CompressNone writes files uncompressed.
+	CompressNone Compression = iota
+	// CompressGzip compresses files with gzip.
+	CompressGzip
+	// CompressZstd compresses files with zstd. It requires the zstd
+	// executable.
+	CompressZstd
+)
+
+var compressionNames = map[Compression]string{
+	CompressNone: "none",
+	CompressGzip: "gzip",
+	CompressZstd: "zstd",
+}
+
+var compressionExtensions = map[Compression]string{
+	CompressGzip: ".gz",
+	CompressZstd: ".zst",
+}
+
+// String returns the name of the compression.
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ParseCompression returns the compression for a name, as returned by String.
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression: %s", name)
+}
+
+// Extension returns the file name extension of the output format.
+func (f OutputFormat) Extension() string {
+	switch f {
+	case OutputJSON:
+		return "jsonl"
+	case OutputWARC:
+		return "warc"
+	default:
+		return "xml"
+	}
+}
+
+// framer is implemented by outputs, which split a harvest into several files,
+// each of which needs the prologue and epilogue of the output format. The
+// header is created for each file, since it may contain a unique identifier.
+type framer interface {
+	SetFrame(header func() ([]byte, error), footer []byte)
+}
+
+// committer is implemented by outputs, which complete written data only
+// later, like a ShardWriter its files. Commit registers a function to call,
+// once everything written so far is complete.
+type committer interface {
+	Commit(f func() error) error
+}
+
+// Shard describes a completed file in the manifest of a ShardWriter.
+type Shard struct {
+	File    string `json:"file"`
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// ShardWriter writes records into a sequence of files in Dir, named like
+// harvest-00001.xml.gz, and starts a new file, once the current one holds
+// MaxRecords records or MaxBytes bytes before compression. Each call to Write
+// is one record, as written by a Harvester.
+//
+// Files are written under a temporary name and renamed, once complete. After
+// each file, a manifest (harvest-manifest.json) lists all completed files with
+// their record count and checksum. A ShardWriter continues the numbering of
+// an existing manifest and skips numbers of files, which are not listed in
+// it, e.g. temporary files left by a crash. Records are marked done in a
+// checkpoint, once their file is complete. It is not safe for concurrent use.
+type ShardWriter struct {
+	Dir         string
+	Prefix      string
+	Extension   string
+	MaxRecords  int
+	MaxBytes    int64
+	Compression Compression
+
+	header  func() ([]byte, error)
+	footer  []byte
+	shards  []Shard
+	loaded  bool
+	current *shardFile
+}
+
+// shardFile is the file currently written.
+type shardFile struct {
+	name    string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	w       io.WriteCloser
+	records int
+	written int64
+	commits []func() error
+}
+
+// NewShardWriter creates a writer for files with a given extension in dir,
+// which rotates after 100000 records.
+func NewShardWriter(dir, ext string) *ShardWriter {
+	return &ShardWriter{
+		Dir:         dir,
+		Prefix:      "harvest",
+		Extension:   ext,
+		MaxRecords:  100000,
+		Compression: CompressGzip,
+	}
+}
+
+// SetFrame sets data to write at the start and end of each file. The header
+// is created for each file.
+func (s *ShardWriter) SetFrame(header func() ([]byte, error), footer []byte) {
+	s.header, s.footer = header, footer
+}
+
+// Shards returns the completed files.
+func (s *ShardWriter) Shards() []Shard {
+	return s.shards
+}
+
+// Commit registers f to be called, once the current file is complete, or
+// calls it at once, if there is none.
+func (s *ShardWriter) Commit(f func() error) error {
+	if s.current == nil {
+		return f()
+	}
+	s.current.commits = append(s.current.commits, f)
+	return nil
+}
+
+// Write writes a record to the current file, starting a new one, if it is
+// full.
+func (s *ShardWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.current != nil && s.full() {
+		if err := s.finish(); err != nil {
+			return 0, err
+		}
+	}
+	if s.current == nil {
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.current.w.Write(p)
+	s.current.written += int64(n)
+	s.current.records++
+	return n, err
+}
+
+// Close finishes the current file and writes the manifest.
+func (s *ShardWriter) Close() error {
+	if s.current != nil {
+		return s.finish()
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.writeManifest()
+}
+
+// full reports, whether the current file reached its limits.
+func (s *ShardWriter) full() bool {
+	c := s.current
+	return (s.MaxRecords > 0 && c.records >= s.MaxRecords) ||
+		(s.MaxBytes > 0 && c.written >= s.MaxBytes)
+}
+
+// manifestName returns the path of the manifest.
+func (s *ShardWriter) manifestName() string {
+	return filepath.Join(s.Dir, s.Prefix+"-manifest.json")
+}
+
+// load reads the manifest of a previous run, if any.
+func (s *ShardWriter) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.loaded = true
+	b, err := ioutil.ReadFile(s.manifestName())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.shards)
+}
+
+// open starts a new file under a temporary name.
+func (s *ShardWriter) open() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	var (
+		name string
+		file *os.File
+		err  error
+	)
+	for i := len(s.shards) + 1; ; i++ {
+		name = fmt.Sprintf("%s-%05d.%s%s", s.Prefix, i, s.Extension,
+			compressionExtensions[s.Compression])
+		if _, err := os.Stat(filepath.Join(s.Dir, name)); err == nil {
+			log.Warn(name, ": not in manifest, skipping")
+			continue
+		}
+		file, err = os.OpenFile(filepath.Join(s.Dir, name+".tmp"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			log.Warn(name, ".tmp: left by an earlier run, skipping")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	c := &shardFile{name: name, file: file, hash: sha256.New()}
+	if c.w, err = compress(s.Compression, io.MultiWriter(file, c.hash, (*countWriter)(&c.size))); err != nil {
+		file.Close()
+		return err
+	}
+	s.current = c
+	if s.header == nil {
+		return nil
+	}
+	header, err := s.header()
+	if err != nil {
+		return err
+	}
+	n, err := c.w.Write(header)
+	c.written += int64(n)
+	return err
+}
+
+// finish completes the current file, renames it and updates the manifest.
+func (s *ShardWriter) finish() error {
+	c := s.current
+	s.current = nil
+	if len(s.footer) > 0 {
+		if _, err := c.w.Write(s.footer); err != nil {
+			c.file.Close()
+			return err
+		}
+	}
+	if err := c.w.Close(); err != nil {
+		c.file.Close()
+		return err
+	}
+	if err := c.file.Sync(); err != nil {
+		c.file.Close()
+		return err
+	}
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(c.file.Name(), filepath.Join(s.Dir, c.name)); err != nil {
+		return err
+	}
+	s.shards = append(s.shards, Shard{
+		File:    c.name,
+		Records: c.records,
+		Bytes:   c.size,
+		SHA256:  hex.EncodeToString(c.hash.Sum(nil)),
+	})
+	if err := s.writeManifest(); err != nil {
+		return err
+	}
+	for _, f := range c.commits {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifest replaces the manifest atomically.
+func (s *ShardWriter) writeManifest() error {
+	shards := s.shards
+	if shards == nil {
+		shards = []Shard{}
+	}
+	b, err := json.MarshalIndent(shards, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	tmp := s.manifestName() + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.manifestName())
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
+// nopWriteCloser adds a no-op Close method to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compress returns a writer compressing data into w.
+func compress(c Compression, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return newZstdWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression: %v", c)
+	}
+}
+
+// zstdWriter compresses data with the zstd executable.
+type zstdWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newZstdWriter(w io.Writer) (*zstdWriter, error) {
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &zstdWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	return z.stdin.Write(p)
+}
+
+// Close waits until all data is compressed.
+func (z *zstdWriter) Close() error {
+	if err := z.stdin.Close(); err != nil {
+		z.cmd.Wait()
+		return err
+	}
+	return z.cmd.Wait()
+}
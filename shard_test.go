@@ -0,0 +1,218 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// readShards checks the manifest against the files in dir and returns the
+// decompressed files.
+func readShards(t *testing.T, dir string, c Compression) [][]byte {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "harvest-manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shards []Shard
+	if err := json.Unmarshal(b, &shards); err != nil {
+		t.Fatal(err)
+	}
+	var result [][]byte
+	for _, shard := range shards {
+		b, err := ioutil.ReadFile(filepath.Join(dir, shard.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(b)
+		if shard.SHA256 != hex.EncodeToString(sum[:]) || shard.Bytes != int64(len(b)) {
+			t.Errorf("%s: checksum or size mismatch", shard.File)
+		}
+		switch c {
+		case CompressGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		case CompressZstd:
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = bytes.NewReader(b)
+			if b, err = cmd.Output(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := bytes.Count(b, []byte("<identifier>")) + bytes.Count(b, []byte(`"identifier"`)); got != shard.Records {
+			t.Errorf("%s: got %d records, manifest says %d", shard.File, got, shard.Records)
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+func TestShardWriter(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-shards-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw := NewShardWriter(dir, OutputXML.Extension())
+	sw.MaxRecords = 10
+	h := NewHarvester(ts.URL)
+	h.Output = sw
+	h.OutputFormat = OutputXML
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := readShards(t, dir, CompressGzip)
+	if len(files) != 3 {
+		t.Fatalf("got %d files, want 3", len(files))
+	}
+	// Each file is a complete document.
+	var total int
+	for _, b := range files {
+		var resp ListRecordsResponse
+		if err := xml.Unmarshal(b, &resp); err != nil {
+			t.Fatal(err)
+		}
+		total += len(resp.ListRecords.Records)
+	}
+	if total != 25 {
+		t.Errorf("got %d records, want 25", total)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "harvest-00003.xml.gz")); err != nil {
+		t.Error(err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(m) > 0 {
+		t.Errorf("temporary files left: %v", m)
+	}
+
+	// Another run continues the numbering.
+	sw = NewShardWriter(dir, OutputXML.Extension())
+	sw.MaxBytes = 1
+	h.Output = sw
+	repo.Identifiers = testIdentifiers(2)
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := readShards(t, dir, CompressGzip); len(files) != 5 {
+		t.Errorf("got %d files, want 5", len(files))
+	}
+}
+
+func TestShardWriterZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	repo := &testRepository{Identifiers: testIdentifiers(15), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-shards-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw := NewShardWriter(dir, OutputJSON.Extension())
+	sw.MaxRecords = 10
+	sw.Compression = CompressZstd
+	h := NewHarvester(ts.URL)
+	h.Output = sw
+	h.OutputFormat = OutputJSON
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := readShards(t, dir, CompressZstd); len(files) != 2 {
+		t.Errorf("got %d files, want 2", len(files))
+	}
+}
+
+func TestShardWriterCrash(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-shards-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.jsonl")
+
+	// The last file of the first run is never finished.
+	c, err := OpenCheckpoint(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := NewShardWriter(dir, OutputXML.Extension())
+	sw.MaxRecords = 10
+	h := NewHarvester(ts.URL)
+	h.Output = sw
+	h.Checkpoint = c
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	sw.current.file.Close()
+	c.Close()
+	if c.Len() != 20 {
+		t.Errorf("got %d records done, want 20 in finished files", c.Len())
+	}
+
+	// The resumed run leaves the temporary file alone.
+	if c, err = OpenCheckpoint(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sw = NewShardWriter(dir, OutputXML.Extension())
+	sw.MaxRecords = 10
+	h.Output = sw
+	h.Checkpoint = c
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 25 {
+		t.Errorf("got %d records done, want 25", c.Len())
+	}
+	var total int
+	for _, shard := range sw.Shards() {
+		total += shard.Records
+	}
+	readShards(t, dir, CompressGzip)
+	if total != 25 {
+		t.Errorf("got %d records in files, want 25", total)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "harvest-00003.xml.gz.tmp")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "harvest-00004.xml.gz")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+package oaicrawl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// IdentifierSource provides identifiers of records to harvest, e.g. from a
+// file. Next advances to the next identifier and reports false at the end or
+// on failure, Value returns the current identifier and Err the error, that
+// stopped the iteration, if any.
+type IdentifierSource interface {
+	Next() bool
+	Value() string
+	Err() error
+}
+
+// readerSource reads identifiers line by line. Lines are not limited in
+// length, since JSON lines may contain whole records.
+type readerSource struct {
+	r     *bufio.Reader
+	value string
+	err   error
+}
+
+// NewReaderSource returns a source reading one identifier per line from r.
+// Surrounding whitespace, empty lines and lines starting with # are ignored.
+// Lines with a JSON object, like a Failure or a JSONRecord, contribute the
+// value of their identifier field, so failure logs and JSON output can be
+// read as well.
+func NewReaderSource(r io.Reader) IdentifierSource {
+	return &readerSource{r: bufio.NewReader(r)}
+}
+
+func (s *readerSource) Next() bool {
+	for s.err == nil {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			s.err = err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			var v struct {
+				Identifier string `json:"identifier"`
+			}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				s.err = err
+				return false
+			}
+			if v.Identifier == "" {
+				continue
+			}
+			line = v.Identifier
+		}
+		s.value = line
+		return true
+	}
+	return false
+}
+
+func (s *readerSource) Value() string { return s.value }
+
+func (s *readerSource) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// sliceSource iterates over a slice of identifiers.
+type sliceSource struct {
+	ids []string
+	i   int
+}
+
+// NewSliceSource returns a source for a list of identifiers.
+func NewSliceSource(ids []string) IdentifierSource {
+	return &sliceSource{ids: ids}
+}
+
+func (s *sliceSource) Next() bool {
+	if s.i >= len(s.ids) {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *sliceSource) Value() string { return s.ids[s.i-1] }
+
+func (s *sliceSource) Err() error { return nil }
+
+// queueSource queues the identifiers of the configured source, skipping
+// identifiers seen before, and returns the number of queued identifiers.
+func (h *Harvester) queueSource(ctx context.Context, seen map[string]bool) (n int, err error) {
+	src := h.Identifiers
+	for src.Next() {
+		ok, err := h.admitIdentifier(src.Value(), seen)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		if !h.enqueue(ctx, src.Value()) {
+			return n, ctx.Err()
+		}
+		n++
+	}
+	return n, src.Err()
+}
@@ -0,0 +1,64 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReaderSource(t *testing.T) {
+	src := NewReaderSource(strings.NewReader("oai:a\n\n# comment\n  oai:b \r\noai:c"))
+	var got []string
+	for src.Next() {
+		got = append(got, src.Value())
+	}
+	if err := src.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "oai:a,oai:b,oai:c" {
+		t.Errorf("got %v, want [oai:a oai:b oai:c]", got)
+	}
+}
+
+func TestReaderSourceLongLines(t *testing.T) {
+	long := `{"identifier":"oai:a","metadata":"` + strings.Repeat("x", 1<<20) + `"}`
+	src := NewReaderSource(strings.NewReader(long + "\noai:b\n"))
+	var got []string
+	for src.Next() {
+		got = append(got, src.Value())
+	}
+	if err := src.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "oai:a,oai:b" {
+		t.Errorf("got %v, want [oai:a oai:b]", got)
+	}
+}
+
+func TestRunIdentifiers(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(20), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Sets = []string{"ignored"}
+	h.Identifiers = NewReaderSource(strings.NewReader("oai:test:3\noai:test:5\noai:test:3\n"))
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got := ids(buf.Bytes())
+	sort.Strings(got)
+	if strings.Join(got, ",") != "oai:test:3,oai:test:5" {
+		t.Errorf("got %v, want [oai:test:3 oai:test:5]", got)
+	}
+	if n := repo.Requests("ListIdentifiers"); n != 0 {
+		t.Errorf("got %d ListIdentifiers requests, want 0", n)
+	}
+	if n := repo.Requests("GetRecord"); n != 2 {
+		t.Errorf("got %d GetRecord requests, want 2", n)
+	}
+}
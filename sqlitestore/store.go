@@ -0,0 +1,226 @@
+// Package sqlitestore keeps harvested records in an SQLite database, so
+// repeated harvests maintain a local mirror of a repository, that can be
+// queried by identifier, set or datestamp.
+package sqlitestore
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miku/oaicrawl"
+
+	// Register the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	identifier TEXT NOT NULL,
+	prefix     TEXT NOT NULL,
+	datestamp  TEXT NOT NULL,
+	deleted    INTEGER NOT NULL,
+	metadata   TEXT NOT NULL,
+	harvested  TEXT NOT NULL,
+	PRIMARY KEY (identifier, prefix)
+);
+CREATE TABLE IF NOT EXISTS sets (
+	identifier TEXT NOT NULL,
+	prefix     TEXT NOT NULL,
+	spec       TEXT NOT NULL,
+	PRIMARY KEY (identifier, prefix, spec)
+);
+CREATE INDEX IF NOT EXISTS records_datestamp ON records (prefix, datestamp);
+CREATE INDEX IF NOT EXISTS sets_spec ON sets (spec);
+`
+
+// Record is a record as stored in the database.
+type Record struct {
+	Identifier     string    `json:"identifier"`
+	MetadataPrefix string    `json:"metadataPrefix"`
+	Datestamp      string    `json:"datestamp"`
+	SetSpecs       []string  `json:"setSpecs,omitempty"`
+	Deleted        bool      `json:"deleted,omitempty"`
+	Metadata       string    `json:"metadata,omitempty"`
+	Harvested      time.Time `json:"harvested"`
+}
+
+// Store is a record store backed by an SQLite database. It implements
+// oaicrawl.RecordStore and can be used as output of a harvester with the raw
+// output format. Each record is inserted or replaced, keyed by identifier
+// and metadata prefix.
+type Store struct {
+	// Format is the metadata prefix of records, whose GetRecord response
+	// does not mention one.
+	Format string
+
+	db *sql.DB
+}
+
+// Open opens or creates a database.
+func Open(filename string) (*Store, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{Format: "oai_dc", db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put inserts or replaces a record, given as GetRecord response.
+func (s *Store) Put(header oaicrawl.Header, b []byte) error {
+	var resp oaicrawl.GetRecordResponse
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("sqlitestore: %s: %s", header.Identifier, err)
+	}
+	rec := Record{
+		Identifier:     header.Identifier,
+		MetadataPrefix: resp.Request.MetadataPrefix,
+		Datestamp:      header.DateStamp,
+		SetSpecs:       header.SetSpec,
+		Deleted:        header.Status == "deleted",
+		Metadata:       string(resp.GetRecord.Record.Metadata.Body),
+		Harvested:      time.Now(),
+	}
+	if rec.MetadataPrefix == "" {
+		rec.MetadataPrefix = s.Format
+	}
+	return s.Upsert(rec)
+}
+
+// Upsert inserts or replaces a record.
+func (s *Store) Upsert(rec Record) error {
+	if rec.Identifier == "" {
+		return errors.New("sqlitestore: record without identifier")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO records (identifier, prefix, datestamp, deleted, metadata, harvested)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (identifier, prefix) DO UPDATE SET
+		datestamp = excluded.datestamp, deleted = excluded.deleted,
+		metadata = excluded.metadata, harvested = excluded.harvested`,
+		rec.Identifier, rec.MetadataPrefix, rec.Datestamp, rec.Deleted, rec.Metadata,
+		rec.Harvested.UTC().Format(time.RFC3339)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM sets WHERE identifier = ? AND prefix = ?`,
+		rec.Identifier, rec.MetadataPrefix); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, spec := range rec.SetSpecs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO sets (identifier, prefix, spec) VALUES (?, ?, ?)`,
+			rec.Identifier, rec.MetadataPrefix, spec); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Write fails, since the store only stores records, which a harvester passes
+// to Put.
+func (s *Store) Write(p []byte) (int, error) {
+	return 0, errors.New("sqlitestore: output format not supported, records only")
+}
+
+// SetFrame ignores the frame of the output format.
+func (s *Store) SetFrame(header func() ([]byte, error), footer []byte) {}
+
+// Query selects records. Empty fields do not restrict the result. From and
+// Until are datestamps in day or second granularity and include records of
+// the whole day, if given as day. A set includes its subsets.
+type Query struct {
+	Identifier     string
+	MetadataPrefix string
+	Set            string
+	From           string
+	Until          string
+	// Deleted includes deleted records.
+	Deleted bool
+}
+
+// Find returns the records matching a query, ordered by datestamp and
+// identifier.
+func (s *Store) Find(q Query) ([]Record, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if q.Identifier != "" {
+		where, args = append(where, "r.identifier = ?"), append(args, q.Identifier)
+	}
+	if q.MetadataPrefix != "" {
+		where, args = append(where, "r.prefix = ?"), append(args, q.MetadataPrefix)
+	}
+	if q.Set != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM sets s WHERE s.identifier = r.identifier
+			AND s.prefix = r.prefix AND (s.spec = ? OR s.spec LIKE ? ESCAPE '\'))`)
+		args = append(args, q.Set, escapeLike(q.Set)+":%")
+	}
+	if q.From != "" {
+		where, args = append(where, "r.datestamp >= ?"), append(args, q.From)
+	}
+	if q.Until != "" {
+		where, args = append(where, "substr(r.datestamp, 1, ?) <= ?"), append(args, len(q.Until), q.Until)
+	}
+	if !q.Deleted {
+		where = append(where, "r.deleted = 0")
+	}
+	query := `SELECT r.identifier, r.prefix, r.datestamp, r.deleted, r.metadata, r.harvested,
+		(SELECT group_concat(spec, char(10)) FROM sets s WHERE s.identifier = r.identifier AND s.prefix = r.prefix)
+		FROM records r`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY r.datestamp, r.identifier"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var (
+			rec       Record
+			harvested string
+			specs     sql.NullString
+		)
+		if err := rows.Scan(&rec.Identifier, &rec.MetadataPrefix, &rec.Datestamp, &rec.Deleted,
+			&rec.Metadata, &harvested, &specs); err != nil {
+			return nil, err
+		}
+		if rec.Harvested, err = time.Parse(time.RFC3339, harvested); err != nil {
+			return nil, err
+		}
+		if specs.String != "" {
+			rec.SetSpecs = strings.Split(specs.String, "\n")
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
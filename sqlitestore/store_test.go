@@ -0,0 +1,104 @@
+package sqlitestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miku/oaicrawl"
+)
+
+// getRecord returns a GetRecord response for a record.
+func getRecord(header oaicrawl.Header, metadata string) []byte {
+	var status, specs string
+	if header.Status != "" {
+		status = fmt.Sprintf(` status="%s"`, header.Status)
+	}
+	for _, spec := range header.SetSpec {
+		specs += "<setSpec>" + spec + "</setSpec>"
+	}
+	return []byte(fmt.Sprintf(`<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">
+<request verb="GetRecord" metadataPrefix="oai_dc">http://example.com/oai</request>
+<GetRecord><record><header%s><identifier>%s</identifier><datestamp>%s</datestamp>%s</header>
+<metadata>%s</metadata></record></GetRecord></OAI-PMH>`,
+		status, header.Identifier, header.DateStamp, specs, metadata))
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "records.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	headers := []oaicrawl.Header{
+		{Identifier: "oai:a", DateStamp: "2017-01-01", SetSpec: []string{"math"}},
+		{Identifier: "oai:b", DateStamp: "2017-01-15T10:00:00Z", SetSpec: []string{"math:algebra", "physics"}},
+		{Identifier: "oai:c", DateStamp: "2017-02-01", SetSpec: []string{"mathematics"}},
+	}
+	for _, h := range headers {
+		if err := s.Put(h, getRecord(h, "<dc>"+h.Identifier+"</dc>")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A record harvested again is replaced.
+	update := oaicrawl.Header{Identifier: "oai:a", DateStamp: "2017-03-01", SetSpec: []string{"physics"}}
+	if err := s.Put(update, getRecord(update, "<dc>updated</dc>")); err != nil {
+		t.Fatal(err)
+	}
+	deleted := oaicrawl.Header{Identifier: "oai:c", DateStamp: "2017-03-02", Status: "deleted"}
+	if err := s.Put(deleted, getRecord(deleted, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		q   Query
+		ids []string
+	}{
+		{Query{}, []string{"oai:b", "oai:a"}},
+		{Query{Deleted: true}, []string{"oai:b", "oai:a", "oai:c"}},
+		{Query{Identifier: "oai:a"}, []string{"oai:a"}},
+		{Query{MetadataPrefix: "mets"}, nil},
+		{Query{Set: "math"}, []string{"oai:b"}},
+		{Query{Set: "physics"}, []string{"oai:b", "oai:a"}},
+		{Query{From: "2017-02-01", Deleted: true}, []string{"oai:a", "oai:c"}},
+		{Query{Until: "2017-01-15"}, []string{"oai:b"}},
+		{Query{From: "2017-01-16", Until: "2017-03-01"}, []string{"oai:a"}},
+	}
+	for _, c := range cases {
+		records, err := s.Find(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, rec := range records {
+			ids = append(ids, rec.Identifier)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(c.ids) {
+			t.Errorf("%+v: got %v, want %v", c.q, ids, c.ids)
+		}
+	}
+
+	records, err := s.Find(Query{Identifier: "oai:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := records[0]
+	if rec.Metadata != "<dc>updated</dc>" || rec.MetadataPrefix != "oai_dc" || rec.Datestamp != "2017-03-01" {
+		t.Errorf("record not replaced: %+v", rec)
+	}
+	if len(rec.SetSpecs) != 1 || rec.SetSpecs[0] != "physics" {
+		t.Errorf("got set specs %v, want [physics]", rec.SetSpecs)
+	}
+	if rec.Harvested.IsZero() {
+		t.Errorf("missing harvest time")
+	}
+}
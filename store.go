@@ -0,0 +1,111 @@
+package oaicrawl
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxFilenameLength keeps file names within the limits of common file systems.
+const maxFilenameLength = 200
+
+// DirStore stores each record as its own file below Dir, so the directory
+// mirrors the current state of the repository. Files are placed into two
+// levels of subdirectories derived from a hash of the identifier, and named
+// after the escaped identifier. Updated records replace their file.
+//
+// Deleted records are removed, or, with Tombstones, kept as a file with a
+// .deleted suffix instead of the record file.
+type DirStore struct {
+	Dir        string
+	Extension  string
+	Tombstones bool
+}
+
+// NewDirStore creates a store for files with a given extension in dir.
+func NewDirStore(dir, ext string) *DirStore {
+	return &DirStore{Dir: dir, Extension: ext}
+}
+
+// Path returns the path of the file of a record.
+func (s *DirStore) Path(identifier string) string {
+	sum := sha1.Sum([]byte(identifier))
+	h := hex.EncodeToString(sum[:])
+	name := url.PathEscape(identifier)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	if len(name) > maxFilenameLength {
+		name = name[:maxFilenameLength-len(h)-1] + "-" + h
+	}
+	return filepath.Join(s.Dir, h[0:2], h[2:4], name+"."+s.Extension)
+}
+
+// Put stores, replaces or removes the file of a record.
+func (s *DirStore) Put(header Header, b []byte) error {
+	if header.Identifier == "" {
+		return errors.New("store: record without identifier")
+	}
+	path := s.Path(header.Identifier)
+	tombstone := path + ".deleted"
+	if header.Status != "deleted" {
+		if err := writeFileAtomic(path, b); err != nil {
+			return err
+		}
+		return removeIfExists(tombstone)
+	}
+	if s.Tombstones {
+		if err := writeFileAtomic(tombstone, b); err != nil {
+			return err
+		}
+	}
+	return removeIfExists(path)
+}
+
+// Write fails, since a DirStore only stores records, which a harvester passes
+// to Put.
+func (s *DirStore) Write(p []byte) (int, error) {
+	return 0, errors.New("store: output format not supported, records only")
+}
+
+// SetFrame ignores the frame of the output format, files contain single
+// records.
+func (s *DirStore) SetFrame(header func() ([]byte, error), footer []byte) {}
+
+// writeFileAtomic writes a file under a temporary name and renames it.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// removeIfExists removes a file, if it exists.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
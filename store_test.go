@@ -0,0 +1,132 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirStorePath(t *testing.T) {
+	s := NewDirStore("/data", "xml")
+	for _, id := range []string{"oai:test:1", "../../etc/passwd", "a/b", ".", strings.Repeat("x", 300)} {
+		path := s.Path(id)
+		rel, err := filepath.Rel("/data", path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			t.Errorf("%q: path outside of store: %s", id, path)
+		}
+		if parts := strings.Split(rel, string(filepath.Separator)); len(parts) != 3 {
+			t.Errorf("%q: got %d path elements, want 3: %s", id, len(parts), rel)
+		}
+		if n := len(filepath.Base(path)); n > 255 {
+			t.Errorf("%q: file name too long: %d", id, n)
+		}
+	}
+	if s.Path("a/b") == s.Path("a%2Fb") {
+		t.Errorf("different identifiers map to the same path")
+	}
+}
+
+func TestRunDirStore(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(5), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDirStore(dir, "xml")
+	store.Tombstones = true
+	h := NewHarvester(ts.URL)
+	h.Output = store
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range repo.Identifiers {
+		b, err := ioutil.ReadFile(store.Path(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(b, []byte("<identifier>"+id+"</identifier>")) {
+			t.Errorf("%s: unexpected content: %s", id, b)
+		}
+	}
+
+	// A deleted record leaves a tombstone.
+	repo.Deleted = map[string]bool{"oai:test:2": true}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.Path("oai:test:2")); !os.IsNotExist(err) {
+		t.Errorf("deleted record not removed")
+	}
+	if _, err := os.Stat(store.Path("oai:test:2") + ".deleted"); err != nil {
+		t.Errorf("missing tombstone: %v", err)
+	}
+
+	// A record restored later replaces its tombstone.
+	repo.Deleted = nil
+	h.Strategy = StrategyListRecords
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.Path("oai:test:2") + ".deleted"); !os.IsNotExist(err) {
+		t.Errorf("tombstone not removed")
+	}
+	var n int
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	if n != 5 {
+		t.Errorf("got %d files, want 5", n)
+	}
+}
+
+func TestRunDirStoreDeletedPolicy(t *testing.T) {
+	for _, policy := range []DeletedPolicy{DeletedSkip, DeletedFile} {
+		repo := &testRepository{Identifiers: testIdentifiers(5), PageSize: 10}
+		ts := httptest.NewServer(repo)
+
+		dir, err := ioutil.TempDir("", "oaicrawl-store-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		store := NewDirStore(dir, "xml")
+		var deletions bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = store
+		h.Deletions = &deletions
+		h.DeletedPolicy = policy
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The deleted record is removed from the store regardless of the
+		// policy.
+		repo.Deleted = map[string]bool{"oai:test:2": true}
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		ts.Close()
+		if _, err := os.Stat(store.Path("oai:test:2")); !os.IsNotExist(err) {
+			t.Errorf("%s: deleted record not removed", policy)
+		}
+		if _, err := os.Stat(store.Path("oai:test:3")); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+		if policy == DeletedFile && !bytes.Contains(deletions.Bytes(), []byte(`"oai:test:2"`)) {
+			t.Errorf("%s: deletion not written: %s", policy, deletions.String())
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Strategy determines how records are requested from an endpoint.
+type Strategy int
+
+const (
+	// StrategyPerRecord lists identifiers and requests each record with
+	// GetRecord. Slow, but works with endpoints that fail on larger responses.
+	StrategyPerRecord Strategy = iota
+	// StrategyListRecords requests records in batches with ListRecords.
+	StrategyListRecords
+	// StrategyAuto starts with ListRecords and requests the remaining records
+	// one by one, once a ListRecords page fails.
+	StrategyAuto
+	// StrategyHybrid uses ListRecords, but requests the records of a failed
+	// page one by one, so only broken records are lost.
+	StrategyHybrid
+)
+
+var strategyNames = map[Strategy]string{
+	StrategyPerRecord:   "per-record",
+	StrategyListRecords: "list-records",
+	StrategyAuto:        "auto",
+	StrategyHybrid:      "hybrid",
+}
+
+var (
+	// tokenPattern finds a resumption token in a response, that cannot be
+	// parsed.
+	tokenPattern = regexp.MustCompile(`<resumptionToken[^>]*>[^<]*</resumptionToken>`)
+	// headerPattern finds the identifiers of record headers in a response,
+	// that cannot be parsed.
+	headerPattern = regexp.MustCompile(`<(?:[\w-]+:)?header(?:\s[^>]*)?>\s*<(?:[\w-]+:)?identifier>([^<]*)<`)
+	// listEndPattern matches the end of a complete ListRecords response.
+	listEndPattern = regexp.MustCompile(`</(?:[\w-]+:)?ListRecords>`)
+)
+
+// String returns the name of the strategy.
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy for a name, as returned by String.
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy: %s", name)
+}
+
+// rawRecord is a record with a parsed header and its element kept verbatim,
+// with the namespace declarations in scope, as returned by extractRecords.
+type rawRecord struct {
+	Header Header `xml:"header"`
+	Raw    []byte `xml:"-"`
+}
+
+// rawListRecordsResponse is a ListRecordsResponse keeping records verbatim.
+type rawListRecordsResponse struct {
+	GenericResponse
+	ListRecords struct {
+		Records []rawRecord `xml:"record"`
+		WithResumptionToken
+	}
+}
+
+// harvestSet harvests the records of a set, or of the whole repository, if set
+// is empty, with the configured strategy. A checkpoint decides, where to
+// continue.
+func (h *Harvester) harvestSet(ctx context.Context, client Fetcher, set, granularity string,
+	seen map[string]bool) (items, requests int, err error) {
+	var listToken, recordsToken string
+	perRecord := h.Strategy == StrategyPerRecord
+	if h.Checkpoint != nil {
+		if h.Checkpoint.Complete("ListIdentifiers", set) || h.Checkpoint.Complete("ListRecords", set) {
+			return 0, 0, nil
+		}
+		listToken = h.Checkpoint.Token("ListIdentifiers", set)
+		recordsToken = h.Checkpoint.Token("ListRecords", set)
+		// A previous run already switched to requesting records one by one.
+		if listToken != "" {
+			perRecord = true
+		}
+	}
+	if perRecord {
+		return h.listSet(ctx, client, set, granularity, listToken, seen)
+	}
+	items, requests, err = h.listRecords(ctx, client, set, granularity, recordsToken, seen)
+	if err == nil || h.Strategy != StrategyAuto || ctx.Err() != nil {
+		return items, requests, err
+	}
+	// Resumption tokens are specific to a verb, so identifiers are listed
+	// from the start, skipping records already written.
+	log.Warn("ListRecords failed, requesting remaining records one by one: ", err)
+	n, r, err := h.listSet(ctx, client, set, granularity, "", seen)
+	return items + n, requests + r, err
+}
+
+// listRecords writes the records of a set, or of the whole repository, if set
+// is empty, page by page, starting at token, if not empty. With
+// StrategyHybrid, the records of a failed page are requested one by one,
+// otherwise the error is returned.
+func (h *Harvester) listRecords(ctx context.Context, client Fetcher, set, granularity, token string,
+	seen map[string]bool) (items, requests int, err error) {
+	first := h.listLink("ListRecords", set, granularity)
+	link := first
+	resumed := token != ""
+	if resumed {
+		link = h.tokenLink("ListRecords", token)
+	}
+	for {
+		log.Debug(link)
+		var lrr rawListRecordsResponse
+		b, err := fetchBody(ctx, client, link)
+		if err == nil {
+			err = decode(link, b, &lrr)
+		}
+		if err == nil {
+			err = keepRecords(link, b, lrr.ListRecords.Records)
+		}
+		if err != nil && !isNoRecordsMatch(err) {
+			if perr, ok := err.(*ProtocolError); ok && resumed && perr.Err.Code == "badResumptionToken" {
+				log.Warn("resumption token expired, listing records from the start")
+				link, token, resumed = first, "", false
+				continue
+			}
+			if h.Strategy != StrategyHybrid || ctx.Err() != nil {
+				return items, requests, err
+			}
+			log.Warn("ListRecords page failed, requesting its records one by one: ", err)
+			n, r, next, err := h.recoverPage(ctx, client, set, granularity, b, seen)
+			items += n
+			requests += r + 1
+			if err != nil {
+				return items, requests, err
+			}
+			if next == "" {
+				return items, requests, nil
+			}
+			token = next
+			link = h.tokenLink("ListRecords", token)
+			continue
+		}
+		resumed = false
+		requests++
+		for _, rec := range lrr.ListRecords.Records {
+			ok, err := h.admit(rec.Header, seen)
+			if err != nil {
+				return items, requests, err
+			}
+			if !ok {
+				continue
+			}
+			r := result{Identifier: rec.Header.Identifier, URL: link, Body: h.envelope(lrr.ResponseDate, rec),
+				Header: rec.Header}
+			select {
+			case h.results <- r:
+				items++
+			case <-ctx.Done():
+				return items, requests, ctx.Err()
+			}
+		}
+		next := lrr.ListRecords.ResumptionToken
+		if err := h.markList("ListRecords", set, next.Value); err != nil {
+			return items, requests, err
+		}
+		if next.Value == "" {
+			return items, requests, nil
+		}
+		token = next.Value
+		link = h.tokenLink("ListRecords", token)
+		if requests%10 == 0 {
+			log.Debug("completed ", requests, " ListRecords requests ",
+				items, "/", next.Cursor, "/", next.CompleteListSize)
+		}
+	}
+}
+
+// recoverPage queues the records of a failed ListRecords page, so each one is
+// requested with GetRecord, and returns the resumption token to continue
+// ListRecords with. Identifiers and token are taken from the body of the page,
+// since resumption tokens are specific to a verb and ListIdentifiers may use
+// pages of a different size. If the page is missing or incomplete, all
+// identifiers are listed from the start instead, skipping records seen
+// before, and the returned token is empty.
+func (h *Harvester) recoverPage(ctx context.Context, client Fetcher, set, granularity string,
+	body []byte, seen map[string]bool) (items, requests int, next string, err error) {
+	if listEndPattern.Match(body) {
+		var headers []Header
+		for _, m := range headerPattern.FindAllSubmatch(body, -1) {
+			headers = append(headers, Header{Identifier: html.UnescapeString(string(m[1]))})
+		}
+		n, err := h.queueHeaders(ctx, headers, seen)
+		if err != nil {
+			return n, 0, "", err
+		}
+		next = extractToken(body)
+		return n, 0, next, h.markList("ListRecords", set, next)
+	}
+	log.Warn("failed ListRecords page is incomplete, requesting remaining records one by one")
+	n, r, err := h.listSet(ctx, client, set, granularity, "", seen)
+	return n, r, "", err
+}
+
+// extractToken returns the resumption token found in an unparsable response.
+func extractToken(b []byte) string {
+	match := tokenPattern.Find(b)
+	if match == nil {
+		return ""
+	}
+	var v struct {
+		Value string `xml:",chardata"`
+	}
+	if err := xml.Unmarshal(match, &v); err != nil {
+		return ""
+	}
+	return v.Value
+}
+
+// markList records the resumption token of a list request in the checkpoint,
+// if any. An empty token marks the list complete.
+func (h *Harvester) markList(verb, set, token string) error {
+	if h.Checkpoint == nil {
+		return nil
+	}
+	if err := h.Checkpoint.markToken(verb, set, token); err != nil {
+		return err
+	}
+	if token == "" {
+		return h.Checkpoint.markComplete(verb, set)
+	}
+	return nil
+}
+
+// keepRecords sets the verbatim elements of the records decoded from a page.
+func keepRecords(link string, b []byte, records []rawRecord) error {
+	elems, err := extractRecords(b)
+	if err == nil && len(elems) != len(records) {
+		err = fmt.Errorf("got %d record elements, want %d", len(elems), len(records))
+	}
+	if err != nil {
+		return &DecodeError{URL: link, Err: err}
+	}
+	for i := range records {
+		records[i].Raw = elems[i]
+	}
+	return nil
+}
+
+// envelope wraps a record of a ListRecords response into a GetRecord
+// response, so the output does not depend on the strategy.
+func (h *Harvester) envelope(responseDate string, rec rawRecord) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/" ` +
+		`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">`)
+	fmt.Fprintf(&buf, "<responseDate>%s</responseDate>", responseDate)
+	buf.WriteString(`<request verb="GetRecord" identifier="`)
+	xml.EscapeText(&buf, []byte(rec.Header.Identifier))
+	buf.WriteString(`" metadataPrefix="`)
+	xml.EscapeText(&buf, []byte(h.Format))
+	buf.WriteString(`">`)
+	xml.EscapeText(&buf, []byte(h.Base))
+	buf.WriteString("</request><GetRecord>")
+	buf.Write(rec.Raw)
+	buf.WriteString("</GetRecord></OAI-PMH>\n")
+	return buf.Bytes()
+}
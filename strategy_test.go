@@ -0,0 +1,330 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []Strategy{StrategyPerRecord, StrategyListRecords, StrategyAuto, StrategyHybrid} {
+		got, err := ParseStrategy(s.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Errorf("got %v, want %v", got, s)
+		}
+	}
+	if _, err := ParseStrategy("bulk"); err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+func TestRunListRecords(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(25), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyListRecords
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.Requests("ListRecords"); got != 3 {
+		t.Errorf("got %d ListRecords requests, want 3", got)
+	}
+	if got := repo.Requests("GetRecord"); got != 0 {
+		t.Errorf("got %d GetRecord requests, want 0", got)
+	}
+
+	// Each record is written as a GetRecord response.
+	dec := xml.NewDecoder(&buf)
+	var n int
+	for {
+		var resp GetRecordResponse
+		if err := dec.Decode(&resp); err != nil {
+			break
+		}
+		if !strings.HasPrefix(resp.GetRecord.Record.Header.Identifier, "oai:test:") {
+			t.Errorf("unexpected identifier: %s", resp.GetRecord.Record.Header.Identifier)
+		}
+		if resp.Request.Verb != "GetRecord" || resp.Request.MetadataPrefix != "oai_dc" {
+			t.Errorf("unexpected request node: %#v", resp.Request)
+		}
+		n++
+	}
+	if n != 25 {
+		t.Errorf("got %d records, want 25", n)
+	}
+}
+
+func TestRunListRecordsNamespaces(t *testing.T) {
+	page, err := ioutil.ReadFile("testdata/ListRecords-01.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &testRepository{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("verb") == "ListRecords" {
+			w.Write(page)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// Prefixes declared on the root, ListRecords and record elements resolve
+	// in each written record.
+	for _, format := range []OutputFormat{OutputRaw, OutputXML} {
+		var buf bytes.Buffer
+		h := NewHarvester(ts.URL)
+		h.Output = &buf
+		h.OutputFormat = format
+		h.Strategy = StrategyListRecords
+		if err := h.Run(); err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]int)
+		dec := xml.NewDecoder(&buf)
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", format, err)
+			}
+			if se, ok := tok.(xml.StartElement); ok {
+				found[se.Name.Space+" "+se.Name.Local]++
+			}
+		}
+		for _, name := range []string{
+			"http://www.openarchives.org/OAI/2.0/oai_dc/ dc",
+			"http://purl.org/dc/elements/1.1/ title",
+			"http://purl.org/dc/terms/ issued",
+		} {
+			if found[name] != 2 {
+				t.Errorf("%v: got %d elements %s, want 2", format, found[name], name)
+			}
+		}
+	}
+}
+
+func TestRunAuto(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(25),
+		PageSize:    10,
+		Broken:      map[string]bool{"oai:test:12": true},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyListRecords
+	if err := h.Run(); err == nil {
+		t.Fatalf("expected error from broken ListRecords page")
+	}
+
+	buf.Reset()
+	h.Strategy = StrategyAuto
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ids(buf.Bytes())); got != 25 {
+		t.Errorf("got %d records, want 25", got)
+	}
+	// The first page is harvested with ListRecords, the rest one by one.
+	if got := repo.Requests("GetRecord"); got != 15 {
+		t.Errorf("got %d GetRecord requests, want 15", got)
+	}
+}
+
+func TestRunAutoVerbTokens(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(25),
+		PageSize:    10,
+		Broken:      map[string]bool{"oai:test:12": true},
+		VerbTokens:  true,
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyAuto
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids(buf.Bytes()) {
+		if seen[id] {
+			t.Errorf("duplicate record: %s", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 25 {
+		t.Errorf("got %d records, want 25", len(seen))
+	}
+	// Identifiers are listed from the start, not with the ListRecords token.
+	forms := repo.Forms("ListIdentifiers")
+	if len(forms) == 0 || forms[0].Get("resumptionToken") != "" {
+		t.Errorf("got ListIdentifiers requests %v", forms)
+	}
+	if got := repo.Requests("GetRecord"); got != 15 {
+		t.Errorf("got %d GetRecord requests, want 15", got)
+	}
+}
+
+func TestRunHybrid(t *testing.T) {
+	repo := &testRepository{
+		Identifiers: testIdentifiers(25),
+		PageSize:    10,
+		Broken:      map[string]bool{"oai:test:12": true},
+		Errors:      map[string]string{"oai:test:12": "cannotDisseminateFormat"},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyHybrid
+	h.BestEffort = true
+	h.MaxElapsedTime = 50 * time.Millisecond
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got := ids(buf.Bytes())
+	if len(got) != 24 {
+		t.Errorf("got %d records, want 24", len(got))
+	}
+	for _, id := range got {
+		if id == "oai:test:12" {
+			t.Errorf("broken record in output")
+		}
+	}
+	// Only the records of the broken page are requested one by one,
+	// ListRecords continues after it.
+	if n := repo.Requests("ListRecords"); n != 3 {
+		t.Errorf("got %d ListRecords requests, want 3", n)
+	}
+	if n := repo.Requests("ListIdentifiers"); n != 0 {
+		t.Errorf("got %d ListIdentifiers requests, want 0", n)
+	}
+	if n := repo.Requests("GetRecord"); n < 10 {
+		t.Errorf("got %d GetRecord requests, want at least 10", n)
+	}
+}
+
+func TestRunHybridVerbTokens(t *testing.T) {
+	repo := &testRepository{
+		Identifiers:     testIdentifiers(25),
+		PageSize:        3,
+		RecordsPageSize: 7,
+		VerbTokens:      true,
+		Broken:          map[string]bool{"oai:test:12": true},
+		Errors:          map[string]string{"oai:test:12": "cannotDisseminateFormat"},
+	}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyHybrid
+	h.BestEffort = true
+	h.MaxElapsedTime = 50 * time.Millisecond
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids(buf.Bytes()) {
+		if seen[id] {
+			t.Errorf("duplicate record: %s", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 24 || seen["oai:test:12"] {
+		t.Errorf("got %d records, want 24 without the broken one", len(seen))
+	}
+	// The page with records 7 to 13 is requested one by one.
+	if n := repo.Requests("GetRecord"); n < 7 {
+		t.Errorf("got %d GetRecord requests, want at least 7", n)
+	}
+	if n := repo.Requests("ListRecords"); n != 4 {
+		t.Errorf("got %d ListRecords requests, want 4", n)
+	}
+}
+
+func TestRunHybridMissingPage(t *testing.T) {
+	repo := &testRepository{
+		Identifiers:     testIdentifiers(25),
+		PageSize:        3,
+		RecordsPageSize: 7,
+		VerbTokens:      true,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("resumptionToken") == "ListRecords:7" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.Strategy = StrategyHybrid
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids(buf.Bytes()) {
+		if seen[id] {
+			t.Errorf("duplicate record: %s", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != 25 {
+		t.Errorf("got %d records, want 25", len(seen))
+	}
+	// Without the page, identifiers are listed from the start and the first
+	// page is not requested again.
+	if n := repo.Requests("GetRecord"); n != 18 {
+		t.Errorf("got %d GetRecord requests, want 18", n)
+	}
+	forms := repo.Forms("ListIdentifiers")
+	if len(forms) != 9 || forms[0].Get("resumptionToken") != "" {
+		t.Errorf("got %d ListIdentifiers requests %v", len(forms), forms)
+	}
+}
+
+func TestExtractToken(t *testing.T) {
+	var cases = []struct {
+		body  string
+		token string
+	}{
+		{"", ""},
+		{"<ListRecords><record>\x01</record></ListRecords>", ""},
+		{`<record>\x01</record><resumptionToken cursor="10">a&amp;b</resumptionToken>`, "a&b"},
+		{`<resumptionToken completeListSize="20"/>`, ""},
+	}
+	for _, c := range cases {
+		if got := extractToken([]byte(c.body)); got != c.token {
+			t.Errorf("extractToken(%q): got %q, want %q", c.body, got, c.token)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package oaicrawl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// exchange is a single HTTP request and response, as sent and received.
+type exchange struct {
+	URL      string
+	Date     time.Time
+	Request  []byte
+	Response []byte
+	// Payload is the body of the response.
+	Payload []byte
+}
+
+// exchangeSink passes exchanges to the writer, until the harvest shuts down.
+type exchangeSink struct {
+	mu      sync.RWMutex
+	closed  bool
+	results chan<- result
+}
+
+// send passes an exchange to the writer. Exchanges completing after shutdown,
+// e.g. of abandoned requests, are dropped.
+func (s *exchangeSink) send(e *exchange) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.closed {
+		s.results <- result{URL: e.URL, Exchange: e}
+	}
+}
+
+// close stops passing exchanges to the writer.
+func (s *exchangeSink) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// recorder is a Fetcher, which records each request and response.
+type recorder struct {
+	Fetcher
+	sink *exchangeSink
+}
+
+// Do performs the request and passes the exchange to the sink. The response
+// body is read completely and replaced.
+func (r *recorder) Do(req *http.Request) (*http.Response, error) {
+	reqBlock, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		return nil, err
+	}
+	date := time.Now()
+	resp, err := r.Fetcher.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var respBlock bytes.Buffer
+	fmt.Fprintf(&respBlock, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	if err := resp.Header.Write(&respBlock); err != nil {
+		return nil, err
+	}
+	respBlock.WriteString("\r\n")
+	respBlock.Write(body)
+
+	r.sink.send(&exchange{
+		URL:      req.URL.String(),
+		Date:     date,
+		Request:  reqBlock,
+		Response: respBlock.Bytes(),
+		Payload:  body,
+	})
+	return resp, nil
+}
+
+// warcField is a named field of a WARC record header.
+type warcField struct {
+	Name, Value string
+}
+
+// warcRecord returns a WARC record, compressed as a single gzip member, so
+// records can be read individually and files can be concatenated.
+func warcRecord(fields []warcField, block []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	fmt.Fprint(zw, "WARC/1.0\r\n")
+	for _, f := range fields {
+		fmt.Fprintf(zw, "%s: %s\r\n", f.Name, f.Value)
+	}
+	fmt.Fprintf(zw, "Content-Length: %d\r\n\r\n", len(block))
+	zw.Write(block)
+	fmt.Fprint(zw, "\r\n\r\n")
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// warcInfo returns a warcinfo record describing the harvest.
+func (h *Harvester) warcInfo(date time.Time) ([]byte, error) {
+	id, err := warcRecordID()
+	if err != nil {
+		return nil, err
+	}
+	block := []byte(fmt.Sprintf("software: oaicrawl\r\nformat: WARC File Format 1.0\r\n"+
+		"description: OAI-PMH harvest of %s, metadataPrefix %s\r\n", h.Base, h.Format))
+	return warcRecord([]warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", id},
+		{"WARC-Date", warcDate(date)},
+		{"Content-Type", "application/warc-fields"},
+		{"WARC-Block-Digest", warcDigest(block)},
+	}, block)
+}
+
+// encodeExchange returns a request and a response record for an exchange.
+func encodeExchange(e *exchange) ([]byte, error) {
+	reqID, err := warcRecordID()
+	if err != nil {
+		return nil, err
+	}
+	respID, err := warcRecordID()
+	if err != nil {
+		return nil, err
+	}
+	date := warcDate(e.Date)
+	req, err := warcRecord([]warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", reqID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", e.URL},
+		{"WARC-Concurrent-To", respID},
+		{"Content-Type", "application/http;msgtype=request"},
+		{"WARC-Block-Digest", warcDigest(e.Request)},
+	}, e.Request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := warcRecord([]warcField{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", respID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", e.URL},
+		{"Content-Type", "application/http;msgtype=response"},
+		{"WARC-Payload-Digest", warcDigest(e.Payload)},
+		{"WARC-Block-Digest", warcDigest(e.Response)},
+	}, e.Response)
+	if err != nil {
+		return nil, err
+	}
+	return append(req, resp...), nil
+}
+
+// warcRecordID returns a random UUID as WARC record identifier.
+func warcRecordID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// warcDate formats a time as required for WARC-Date.
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// warcDigest returns the SHA-1 digest of b, labelled and base32 encoded.
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,199 @@
+package oaicrawl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readWARC returns the header fields and blocks of gzip compressed WARC
+// records, one gzip member per record.
+func readWARC(t *testing.T, b []byte) (headers []map[string]string, blocks [][]byte) {
+	br := bufio.NewReader(bytes.NewReader(b))
+	for {
+		zr, err := gzip.NewReader(br)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr.Multistream(false)
+		rec, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := bytes.Index(rec, []byte("\r\n\r\n"))
+		if i < 0 || !bytes.HasPrefix(rec, []byte("WARC/1.0\r\n")) {
+			t.Fatalf("malformed record: %q", rec)
+		}
+		header := make(map[string]string)
+		for _, line := range strings.Split(string(rec[10:i]), "\r\n") {
+			kv := strings.SplitN(line, ": ", 2)
+			header[kv[0]] = kv[1]
+		}
+		n, err := strconv.Atoi(header["Content-Length"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := rec[i+4:]
+		if len(block) != n+4 || !bytes.HasSuffix(block, []byte("\r\n\r\n")) {
+			t.Fatalf("block length mismatch: %d, want %d", len(block), n+4)
+		}
+		headers = append(headers, header)
+		blocks = append(blocks, block[:n])
+	}
+}
+
+func TestRunWARC(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(15), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.OutputFormat = OutputWARC
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	headers, blocks := readWARC(t, buf.Bytes())
+	// One warcinfo record, then request and response per exchange: two
+	// ListIdentifiers and 15 GetRecord requests.
+	if len(headers) != 1+2*17 {
+		t.Fatalf("got %d records, want %d", len(headers), 1+2*17)
+	}
+	if headers[0]["WARC-Type"] != "warcinfo" {
+		t.Errorf("got %s, want warcinfo first", headers[0]["WARC-Type"])
+	}
+	var getRecord int
+	for i, header := range headers[1:] {
+		block := blocks[i+1]
+		if header["WARC-Block-Digest"] != warcDigest(block) {
+			t.Errorf("block digest mismatch")
+		}
+		if header["WARC-Date"] == "" || header["WARC-Record-ID"] == "" {
+			t.Errorf("missing date or record id: %v", header)
+		}
+		if !strings.HasPrefix(header["WARC-Target-URI"], ts.URL) {
+			t.Errorf("unexpected target: %s", header["WARC-Target-URI"])
+		}
+		switch header["WARC-Type"] {
+		case "request":
+			if !bytes.HasPrefix(block, []byte("GET ")) {
+				t.Errorf("unexpected request: %q", block)
+			}
+			// The response follows its request.
+			if headers[i+2]["WARC-Record-ID"] != header["WARC-Concurrent-To"] {
+				t.Errorf("request not followed by its response")
+			}
+		case "response":
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header["WARC-Payload-Digest"] != warcDigest(payload) {
+				t.Errorf("payload digest mismatch")
+			}
+			if strings.Contains(header["WARC-Target-URI"], "verb=GetRecord") {
+				getRecord++
+			}
+		default:
+			t.Errorf("unexpected record type: %s", header["WARC-Type"])
+		}
+	}
+	if getRecord != 15 {
+		t.Errorf("got %d GetRecord responses, want 15", getRecord)
+	}
+}
+
+func TestRunWARCRetries(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(3), PageSize: 10}
+	var once sync.Once
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("identifier") == "oai:test:1" {
+			var failed bool
+			once.Do(func() { failed = true })
+			if failed {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		repo.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	h := NewHarvester(ts.URL)
+	h.Output = &buf
+	h.OutputFormat = OutputWARC
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Both attempts of the failed record are recorded.
+	headers, blocks := readWARC(t, buf.Bytes())
+	var statuses []string
+	for i, header := range headers {
+		if header["WARC-Type"] == "response" && strings.Contains(header["WARC-Target-URI"], "oai%3Atest%3A1") {
+			statuses = append(statuses, string(blocks[i][9:12]))
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != "503" || statuses[1] != "200" {
+		t.Errorf("got responses %v, want 503 and 200", statuses)
+	}
+}
+
+func TestShardWriterWARC(t *testing.T) {
+	repo := &testRepository{Identifiers: testIdentifiers(5), PageSize: 10}
+	ts := httptest.NewServer(repo)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "oaicrawl-warc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw := NewShardWriter(dir, OutputWARC.Extension())
+	sw.Compression = CompressNone
+	sw.MaxRecords = 4
+	h := NewHarvester(ts.URL)
+	h.Output = sw
+	h.OutputFormat = OutputWARC
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Each file starts with a warcinfo record of its own.
+	ids := make(map[string]bool)
+	for _, shard := range sw.Shards() {
+		b, err := ioutil.ReadFile(filepath.Join(dir, shard.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers, _ := readWARC(t, b)
+		if len(headers) == 0 || headers[0]["WARC-Type"] != "warcinfo" {
+			t.Fatalf("%s: no warcinfo record", shard.File)
+		}
+		ids[headers[0]["WARC-Record-ID"]] = true
+	}
+	if len(sw.Shards()) < 2 || len(ids) != len(sw.Shards()) {
+		t.Errorf("got %d warcinfo ids in %d files", len(ids), len(sw.Shards()))
+	}
+}